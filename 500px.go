@@ -5,7 +5,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
@@ -44,7 +46,7 @@ type FiveHundredPxAPI struct {
 	BaseURL string
 }
 
-func (fa *FiveHundredPxAPI) FetchMediaItems(options APIFetchOptions) ([]*MediaItem, error) {
+func (fa *FiveHundredPxAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
 	profileParts := strings.Split(options.Profile, ":")
 	feature := profileParts[0]
 
@@ -77,33 +79,34 @@ func (fa *FiveHundredPxAPI) FetchMediaItems(options APIFetchOptions) ([]*MediaIt
 	q.Set("image_size", sizeID)
 
 	limit := options.Limit
-	pages := ceilIntDivision(limit, FiveHundredPxPageSize)
 	items := make([]*MediaItem, 0, limit)
 
-	for page := 1; page <= pages; page++ {
+	q.Set("rpp", strconv.Itoa(FiveHundredPxPageSize))
+
+	// Photos without images are skipped, so pages are requested
+	// until the limit is reached rather than a precomputed number.
+	for page := 1; limit > 0; page++ {
 		q.Set("page", strconv.Itoa(page))
-		q.Set("rpp", strconv.Itoa(FiveHundredPxPageSize))
 
 		profileURL.RawQuery = q.Encode()
 
-		pageItems, err := fa.fetchItemsForPage(profileURL.String(), size, options.Square)
+		pageItems, photos, err := fa.fetchItemsForPage(ctx, profileURL.String(), size, options.Square)
 		if err != nil {
 			return nil, err
 		}
 
-		// API sources drained.
-		if len(pageItems) == 0 {
-			break
+		// Remove any items over limit
+		if len(pageItems) > limit {
+			pageItems = pageItems[:limit]
 		}
 
+		items = append(items, pageItems...)
 		limit -= len(pageItems)
 
-		// Remove any items over limit
-		if limit < 0 {
-			pageItems = pageItems[:len(pageItems)+limit]
+		// API sources drained.
+		if photos < FiveHundredPxPageSize {
+			break
 		}
-
-		items = append(items, pageItems...)
 	}
 
 	return items, nil
@@ -135,10 +138,10 @@ func (fa *FiveHundredPxAPI) findBestSize(size int, square bool) (string, int) {
 	return bestID, bestSize
 }
 
-func (fa *FiveHundredPxAPI) fetchItemsForPage(url string, size int, square bool) ([]*MediaItem, error) {
-	resp, err := http.Get(url)
+func (fa *FiveHundredPxAPI) fetchItemsForPage(ctx context.Context, url string, size int, square bool) ([]*MediaItem, int, error) {
+	resp, err := httpGet(ctx, url)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	defer resp.Body.Close()
@@ -148,33 +151,38 @@ func (fa *FiveHundredPxAPI) fetchItemsForPage(url string, size int, square bool)
 			Error string `json:"error"`
 		}
 
-		if err := json.NewDecoder(resp.Body).Decode(&errInfo); err != nil {
-			return nil, err
+		if err := json.NewDecoder(resp.Body).Decode(&errInfo); err != nil || len(errInfo.Error) == 0 {
+			return nil, 0, fmt.Errorf("500px responded with %q", resp.Status)
 		}
 
-		return nil, fmt.Errorf(errInfo.Error)
+		return nil, 0, errors.New(errInfo.Error)
 	}
 
 	var media struct {
 		Photos []*struct {
-			ID     int `json:"id"`
-			Width  int `json:"width"`
-			Height int `json:"height"`
-			Images []*struct {
+			ID         int `json:"id"`
+			Width      int `json:"width"`
+			Height     int `json:"height"`
+			VotesCount int `json:"votes_count"`
+			Images     []*struct {
 				URL string `json:"url"`
 			} `json:"images"`
 		} `json:"photos"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&media); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Preallocate items slice
-	mediaItems := make([]*MediaItem, len(media.Photos))
+	mediaItems := make([]*MediaItem, 0, len(media.Photos))
+
+	for _, photo := range media.Photos {
+		if len(photo.Images) == 0 || (!square && (photo.Width == 0 || photo.Height == 0)) {
+			continue
+		}
 
-	for i, photo := range media.Photos {
-		item := &MediaItem{ID: strconv.Itoa(photo.ID), URL: photo.Images[0].URL}
+		item := &MediaItem{ID: strconv.Itoa(photo.ID), URL: photo.Images[0].URL, Score: photo.VotesCount}
 
 		if square {
 			item.Width = size
@@ -189,10 +197,10 @@ func (fa *FiveHundredPxAPI) fetchItemsForPage(url string, size int, square bool)
 			item.Height = int(ratio * float64(photo.Height))
 		}
 
-		mediaItems[i] = item
+		mediaItems = append(mediaItems, item)
 	}
 
-	return mediaItems, nil
+	return mediaItems, len(media.Photos), nil
 }
 
 func NewFiveHundredPxAPI(key string) API {
@@ -0,0 +1,90 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Infix of temporary files, see writeFileAtomic.
+const TempFileInfix = ".tmp-"
+
+// writeFileAtomic writes a file by writing to a temporary file in the same
+// directory first and renaming it afterwards. Readers therefore see either
+// the old or the complete new file, never a partially written one.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir, name := filepath.Split(path)
+
+	file, err := ioutil.TempFile(dir, "."+name+TempFileInfix)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := file.Name()
+
+	// Remove the temporary file if anything goes wrong.
+	success := false
+	defer func() {
+		if !success {
+			file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err := write(file); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// Temporary files are only readable by the owner.
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	success = true
+	return nil
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, TempFileInfix)
+}
+
+// removeTempFiles removes the temporary files left over by
+// interrupted runs.
+func removeTempFiles(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !isTempFile(file.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		log.Printf("Removing incomplete file %q", path)
+
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error: Failed to remove %q, %s", path, err.Error())
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum length of the readable part of a cache namespace
+	MaxNamespaceNameLength = 64
+
+	// Suffix of the metadata file stored next to each cached image
+	CacheMetaSuffix = ".meta.json"
+)
+
+var unsafeNamespaceChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// cacheNamespace returns the name of the cache directory of a source.
+// Every api, profile, tag, size and square variant has its own
+// namespace, so that neither IDs of different APIs collide nor the
+// cleanup of one wallpaper removes the images of another one. A size
+// of 0 stands for the sizes computed by -fit.
+func cacheNamespace(source *Source, size int, square bool) string {
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%t", source.APIName, source.Profile, source.Tag, size, square)
+	sum := sha1.Sum([]byte(key))
+
+	name := source.APIName + "-" + source.Profile
+	if len(source.Tag) > 0 {
+		name += "-" + source.Tag
+	}
+
+	name = unsafeNamespaceChars.ReplaceAllString(name, "_")
+	if len(name) > MaxNamespaceNameLength {
+		name = name[:MaxNamespaceNameLength]
+	}
+
+	variant := fmt.Sprintf("%d", size)
+	if size == 0 {
+		variant = "fit"
+	}
+
+	if square {
+		variant += "sq"
+	}
+
+	// The hash keeps namespaces unique even if the readable
+	// part is truncated or contains replaced characters.
+	return fmt.Sprintf("%s-%s-%x", name, variant, sum[:4])
+}
+
+// setupCacheNamespaces assigns each source its cache directory
+// and creates it.
+func setupCacheNamespaces(sources []*Source) {
+	// The size computed by -fit changes with the options and the canvas,
+	// which shouldn't move the cached images to another namespace.
+	size := gridSize
+	if fit {
+		size = 0
+	}
+
+	for _, source := range sources {
+		source.CacheDir = filepath.Join(cacheDir, cacheNamespace(source, size, squareTiles))
+		createDir(source.CacheDir)
+		removeTempFiles(source.CacheDir)
+	}
+}
+
+// cachePath returns the path of the cached image file of the item.
+func (item *MediaItem) cachePath() string {
+	return filepath.Join(item.Source.CacheDir, item.ID)
+}
+
+// CacheMeta is the metadata record stored next to each cached image.
+type CacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+
+	// Dimensions of the original image, before cropping
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// SHA-256 of the original image data
+	Hash string `json:"hash"`
+
+	// Size and SHA-256 of the cached file, used to detect corrupt files
+	FileSize int64  `json:"file_size"`
+	FileHash string `json:"file_hash"`
+
+	// Position of the item in the last wallpaper and the size of the
+	// cached image, used to restore the items offline.
+	Index        int    `json:"index"`
+	CachedWidth  int    `json:"cached_width"`
+	CachedHeight int    `json:"cached_height"`
+	Author       string `json:"author,omitempty"`
+	AuthorURL    string `json:"author_url,omitempty"`
+	Score        int    `json:"score,omitempty"`
+
+	// Time the image was last used in a wallpaper
+	LastUsed time.Time `json:"last_used"`
+}
+
+func (item *MediaItem) cacheMetaPath() string {
+	return item.cachePath() + CacheMetaSuffix
+}
+
+func loadCacheMeta(item *MediaItem) (*CacheMeta, error) {
+	file, err := os.Open(item.cacheMetaPath())
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	meta := &CacheMeta{}
+	if err := json.NewDecoder(file).Decode(meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func saveCacheMeta(item *MediaItem, meta *CacheMeta) error {
+	return writeFileAtomic(item.cacheMetaPath(), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(meta)
+	})
+}
+
+// cacheID returns the item ID a cache file belongs to.
+func cacheID(fileName string) string {
+	return strings.TrimSuffix(fileName, CacheMetaSuffix)
+}
+
+type cachedItemsByIndex struct {
+	items []*MediaItem
+	metas []*CacheMeta
+}
+
+func (c cachedItemsByIndex) Len() int { return len(c.items) }
+func (c cachedItemsByIndex) Swap(i, j int) {
+	c.items[i], c.items[j] = c.items[j], c.items[i]
+	c.metas[i], c.metas[j] = c.metas[j], c.metas[i]
+}
+func (c cachedItemsByIndex) Less(i, j int) bool {
+	return c.metas[i].Index < c.metas[j].Index
+}
+
+// loadCachedItems restores the items of a source from its cache
+// namespace, in the order of the last wallpaper.
+func loadCachedItems(source *Source) ([]*MediaItem, error) {
+	files, err := ioutil.ReadDir(source.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var cached cachedItemsByIndex
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), CacheMetaSuffix) {
+			continue
+		}
+
+		item := &MediaItem{ID: cacheID(file.Name()), Source: source}
+
+		meta, err := loadCacheMeta(item)
+		if err != nil {
+			log.Printf("Error: Failed to read metadata of %q, %s", item.ID, err.Error())
+			continue
+		}
+
+		item.URL = meta.URL
+		item.Width = meta.CachedWidth
+		item.Height = meta.CachedHeight
+		item.Author = meta.Author
+		item.AuthorURL = meta.AuthorURL
+		item.Score = meta.Score
+
+		if !checkCachedImage(item, meta) {
+			continue
+		}
+
+		cached.items = append(cached.items, item)
+		cached.metas = append(cached.metas, meta)
+	}
+
+	sort.Stable(cached)
+
+	return cached.items, nil
+}
+
+// loadCachedSources restores the items of all sources from the cache and
+// interleaves them like fetched items. It fails if there aren't enough
+// cached images for the requested number of tiles.
+func loadCachedSources(sources []*Source, limit int) []*MediaItem {
+	results := make([][]*MediaItem, len(sources))
+	found := 0
+
+	for i, source := range sources {
+		items, err := loadCachedItems(source)
+		fatalIf(err)
+
+		log.Printf("Found %d cached images for %s", len(items), source)
+		results[i] = items
+		found += len(items)
+	}
+
+	if found < limit {
+		fatalIf(fmt.Errorf("Not enough cached images for offline mode, found %d of %d", found, limit))
+	}
+
+	return interleaveItems(results, sources, limit)
+}
+
+func shuffleItems(items []*MediaItem) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for i := len(items) - 1; i > 0; i-- {
+		j := rnd.Intn(i + 1)
+		items[i], items[j] = items[j], items[i]
+	}
+}
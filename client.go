@@ -0,0 +1,77 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpClient is shared by the API fetchers and the downloader, so that
+// connections are reused and the per host limits apply to all requests.
+var httpClient = http.DefaultClient
+
+// timeoutConn fails reads which receive no data within the timeout.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func setupHTTPClient() {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || readTimeout <= 0 {
+				return conn, err
+			}
+
+			return &timeoutConn{conn, readTimeout}, nil
+		},
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxHostConns,
+		MaxConnsPerHost:       maxHostConns,
+	}
+
+	var roundTripper http.RoundTripper = newRetryTransport(transport, maxRetries)
+
+	switch {
+	case len(replayDir) > 0:
+		roundTripper = &replayTransport{replayDir}
+	case len(recordDir) > 0:
+		roundTripper = &recordTransport{roundTripper, recordDir}
+	}
+
+	httpClient = &http.Client{Transport: roundTripper}
+}
+
+// httpGet requests the URL with the shared client. The request is
+// canceled with the context.
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return httpClient.Do(req.WithContext(ctx))
+}
@@ -0,0 +1,337 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	FeaturedByFirst   = "first"
+	FeaturedByPopular = "popular"
+)
+
+func parseFeaturedOptions() {
+	if len(featuredIDs) > 0 && featured == 0 {
+		featured = len(strings.Split(featuredIDs, ","))
+	}
+
+	if featured < 0 {
+		fatalIf(fmt.Errorf("-featured must not be negative"))
+	}
+
+	if featured == 0 {
+		return
+	}
+
+	switch featuredBy {
+	case FeaturedByFirst, FeaturedByPopular:
+	default:
+		fatalIf(fmt.Errorf("Unknown -featured-by %q - use first or popular", featuredBy))
+	}
+
+	if featuredSpan != 2 && featuredSpan != 3 {
+		fatalIf(fmt.Errorf("-featured-span must be 2 or 3"))
+	}
+
+	if layout != LayoutGrid || !squareTiles {
+		fatalIf(fmt.Errorf("-featured requires the grid layout with square tiles, add -square"))
+	}
+}
+
+// selectFeatured marks the items which span several grid cells. These are
+// either the items with the given IDs, or the first or most popular items.
+// Placeholders of failed downloads are never featured.
+func selectFeatured(items []*MediaItem) {
+	var candidates []*MediaItem
+
+	for _, item := range items {
+		if !item.Placeholder {
+			candidates = append(candidates, item)
+		}
+	}
+
+	if len(featuredIDs) > 0 {
+		byID := make(map[string]*MediaItem, len(candidates))
+		for _, item := range candidates {
+			byID[item.ID] = item
+		}
+
+		var selected []*MediaItem
+
+		for _, id := range strings.Split(featuredIDs, ",") {
+			id = strings.TrimSpace(id)
+
+			if item := byID[id]; item != nil {
+				selected = append(selected, item)
+			} else {
+				log.Printf("Warning: featured image %q not found", id)
+			}
+		}
+
+		candidates = selected
+	} else if featuredBy == FeaturedByPopular {
+		sort.Stable(itemsByScore(candidates))
+
+		if len(candidates) > 0 && candidates[0].Score == 0 {
+			log.Printf("Warning: no popularity scores available, featuring the first images")
+		}
+	}
+
+	for _, item := range candidates[:minInt(featured, len(candidates))] {
+		item.Featured = true
+	}
+}
+
+type itemsByScore []*MediaItem
+
+func (s itemsByScore) Len() int           { return len(s) }
+func (s itemsByScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s itemsByScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
+
+// tileSpan returns the number of grid cells per side covered by the item.
+func tileSpan(item *MediaItem) int {
+	if item.Featured {
+		return featuredSpan
+	}
+
+	return 1
+}
+
+// featuredCells returns the number of grid cells needed by n items, of
+// which up to -featured span several cells.
+func featuredCells(n int) int {
+	return n + minInt(featured, n)*(featuredSpan*featuredSpan-1)
+}
+
+// featuredTile is an item placed at a cell of the featured grid.
+type featuredTile struct {
+	item     *MediaItem
+	row, col int
+	span     int
+}
+
+// featuredGrid is the packed square grid with featured tiles.
+type featuredGrid struct {
+	tiles      []*featuredTile
+	rows, cols int
+
+	// Number of empty cells
+	holes int
+}
+
+// packFeaturedGrid places the items into a grid of at most maxCols
+// columns. Like drawSquareGrid, the grid has as few rows as maxCols
+// columns allow and the cells are filled column by column. Featured
+// tiles are placed first, each close to its place in the order, then the
+// single tiles fill the remaining cells. Featured tiles are kept off the
+// cells left over at the end, so that empty cells only remain at the
+// bottom of the last column, like in drawSquareGrid. If that's impossible
+// for any number of rows, e.g. if the grid is only as wide as a featured
+// tile, empty cells are allowed anywhere.
+func packFeaturedGrid(items []*MediaItem, maxCols int) *featuredGrid {
+	cells, span := 0, 1
+	for _, item := range items {
+		cells += tileSpan(item) * tileSpan(item)
+		span = maxInt(span, tileSpan(item))
+	}
+
+	// Featured tiles need at least span columns.
+	minRows := ceilIntDivision(maxInt(cells, 1), maxInt(maxCols, span))
+
+	for rows := maxInt(minRows, span); rows <= cells; rows++ {
+		cols := ceilIntDivision(cells, rows)
+		if cols < span {
+			break
+		}
+
+		if tiles, ok := packFeaturedCells(items, rows, cols, cells); ok {
+			return &featuredGrid{tiles, rows, cols, rows*cols - cells}
+		}
+	}
+
+	cols := maxInt(ceilIntDivision(maxInt(cells, 1), minRows), span)
+
+	for rows := maxInt(minRows, span); ; rows++ {
+		if tiles, ok := packFeaturedCells(items, rows, cols, rows*cols); ok {
+			return &featuredGrid{tiles, rows, cols, rows*cols - cells}
+		}
+	}
+}
+
+// MaxFeaturedPackSteps limits the positions tried for the featured
+// tiles of one grid size, as the search may take exponential time if
+// there is no solution.
+const MaxFeaturedPackSteps = 10000
+
+// packFeaturedCells packs the items into a grid of the given size, whose
+// cells are numbered column by column. Featured tiles only cover cells
+// numbered below limit. Each featured tile prefers the free position
+// closest to its place in the order; if a later tile doesn't fit, the
+// earlier ones are moved. It fails if the featured tiles don't fit.
+func packFeaturedCells(items []*MediaItem, rows, cols, limit int) ([]*featuredTile, bool) {
+	occupied := make([]bool, rows*cols)
+	tiles := make([]*featuredTile, len(items))
+
+	fits := func(pos, span int) bool {
+		row, col := pos%rows, pos/rows
+		if row+span > rows || col+span > cols || (col+span-1)*rows+row+span-1 >= limit {
+			return false
+		}
+
+		for c := col; c < col+span; c++ {
+			for r := row; r < row+span; r++ {
+				if occupied[c*rows+r] {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	mark := func(pos, span int, value bool) {
+		row, col := pos%rows, pos/rows
+		for c := col; c < col+span; c++ {
+			for r := row; r < row+span; r++ {
+				occupied[c*rows+r] = value
+			}
+		}
+	}
+
+	// Featured items and the number of cells preceding them in the order
+	var indices, targets []int
+	cell := 0
+
+	for i, item := range items {
+		if tileSpan(item) > 1 {
+			indices = append(indices, i)
+			targets = append(targets, cell)
+		}
+
+		cell += tileSpan(item) * tileSpan(item)
+	}
+
+	steps := 0
+
+	var place func(k int) bool
+	place = func(k int) bool {
+		if k == len(indices) {
+			return true
+		}
+
+		item := items[indices[k]]
+		span := tileSpan(item)
+		target := minInt(targets[k], len(occupied)-1)
+
+		// Try the positions from the target on, then those before it.
+		for d := 0; d < len(occupied); d++ {
+			pos := target + d
+			if pos >= len(occupied) {
+				pos = len(occupied) - 1 - d
+			}
+
+			if steps++; steps > MaxFeaturedPackSteps {
+				return false
+			}
+
+			if !fits(pos, span) {
+				continue
+			}
+
+			mark(pos, span, true)
+			tiles[indices[k]] = &featuredTile{item, pos % rows, pos / rows, span}
+
+			if place(k + 1) {
+				return true
+			}
+
+			mark(pos, span, false)
+			tiles[indices[k]] = nil
+		}
+
+		return false
+	}
+
+	if !place(0) {
+		return nil, false
+	}
+
+	// There are at least as many cells as tiles, so every single
+	// tile finds a free cell.
+	pos := 0
+
+	for i, item := range items {
+		if tiles[i] != nil {
+			continue
+		}
+
+		for occupied[pos] {
+			pos++
+		}
+
+		occupied[pos] = true
+		tiles[i] = &featuredTile{item, pos % rows, pos / rows, 1}
+	}
+
+	return tiles, true
+}
+
+// trimToCompleteFeaturedGrid drops the fewest trailing single tiles,
+// so that the packed grid has no empty cells. The items are returned
+// unchanged if there is no such number.
+func trimToCompleteFeaturedGrid(items []*MediaItem) []*MediaItem {
+	n := completeFeaturedCount(items, gridCols)
+	if n < len(items) {
+		log.Printf("Dropping %d images to complete the last row", len(items)-n)
+	}
+
+	return items[:n]
+}
+
+// completeFeaturedCount returns the number of leading items which pack
+// into a grid of at most maxCols columns without empty cells, or all
+// items if there is no such number.
+func completeFeaturedCount(items []*MediaItem, maxCols int) int {
+	for n := len(items); n > 0; n-- {
+		if packFeaturedGrid(items[:n], maxCols).holes == 0 {
+			return n
+		}
+
+		if items[n-1].Featured {
+			break
+		}
+	}
+
+	return len(items)
+}
+
+// drawFeaturedGrid draws the items into a square grid of -cols columns,
+// in which featured items span -featured-span cells per side.
+func drawFeaturedGrid(ctx context.Context, wp *image.RGBA, items []*MediaItem) {
+	grid := packFeaturedGrid(items, gridCols)
+
+	dx := (outputWidth - (grid.cols*(gridSize+gridHSpacing) - gridHSpacing)) / 2
+	dy := (outputHeight - (grid.rows*(gridSize+gridVSpacing) - gridVSpacing)) / 2
+
+	if dx < 0 || dy < 0 {
+		log.Printf("Warning: grid exceeds the output size, consider specifying a smaller grid size with --grid")
+	}
+
+	for _, tile := range grid.tiles {
+		exitIfCanceled(ctx)
+
+		// Featured images are scaled up, as all images are fetched in the grid size.
+		min := image.Pt(dx+tile.col*(gridSize+gridHSpacing), dy+tile.row*(gridSize+gridVSpacing))
+		max := min.Add(image.Pt(tile.span*(gridSize+gridHSpacing)-gridHSpacing, tile.span*(gridSize+gridVSpacing)-gridVSpacing))
+
+		drawTile(wp, tile.item, image.Rectangle{min, max})
+	}
+}
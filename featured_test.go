@@ -0,0 +1,255 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// withFeaturedOptions sets the featured options for a test and returns
+// a function restoring them.
+func withFeaturedOptions(count, span int, by, ids string) func() {
+	oldFeatured, oldSpan, oldBy, oldIDs := featured, featuredSpan, featuredBy, featuredIDs
+	featured, featuredSpan, featuredBy, featuredIDs = count, span, by, ids
+
+	return func() {
+		featured, featuredSpan, featuredBy, featuredIDs = oldFeatured, oldSpan, oldBy, oldIDs
+	}
+}
+
+// newFeaturedItems returns n items, of which those at the given
+// positions are featured.
+func newFeaturedItems(n int, positions ...int) []*MediaItem {
+	items := make([]*MediaItem, n)
+	for i := range items {
+		items[i] = &MediaItem{ID: fmt.Sprintf("%d", i)}
+	}
+
+	for _, p := range positions {
+		items[p].Featured = true
+	}
+
+	return items
+}
+
+// checkFeaturedGrid verifies that the tiles don't overlap and lie within
+// the grid. If trailing is set, the empty cells must be the last cells,
+// numbered column by column.
+func checkFeaturedGrid(t *testing.T, name string, items []*MediaItem, grid *featuredGrid, trailing bool) {
+	if len(grid.tiles) != len(items) {
+		t.Errorf("%s: %d tiles, want %d", name, len(grid.tiles), len(items))
+		return
+	}
+
+	occupied := make([]bool, grid.rows*grid.cols)
+
+	for i, tile := range grid.tiles {
+		if tile.item != items[i] || tile.span != tileSpan(items[i]) {
+			t.Errorf("%s: tile %d is item %s with span %d", name, i, tile.item.ID, tile.span)
+		}
+
+		if tile.row+tile.span > grid.rows || tile.col+tile.span > grid.cols {
+			t.Errorf("%s: tile %d at %d,%d exceeds the %dx%d grid", name, i, tile.row, tile.col, grid.rows, grid.cols)
+			return
+		}
+
+		for c := tile.col; c < tile.col+tile.span; c++ {
+			for r := tile.row; r < tile.row+tile.span; r++ {
+				if occupied[c*grid.rows+r] {
+					t.Errorf("%s: tiles overlap at %d,%d", name, r, c)
+				}
+
+				occupied[c*grid.rows+r] = true
+			}
+		}
+	}
+
+	holes := 0
+	for i, o := range occupied {
+		if !o {
+			holes++
+		} else if holes > 0 && trailing {
+			t.Errorf("%s: empty cell before cell %d of the %dx%d grid\n%s", name, i, grid.rows, grid.cols, formatFeaturedGrid(grid))
+			return
+		}
+	}
+
+	if holes != grid.holes {
+		t.Errorf("%s: %d empty cells, grid reports %d", name, holes, grid.holes)
+	}
+}
+
+func formatFeaturedGrid(grid *featuredGrid) string {
+	cells := make([][]string, grid.rows)
+	for r := range cells {
+		cells[r] = strings.Split(strings.Repeat(".", grid.cols), "")
+	}
+
+	for _, tile := range grid.tiles {
+		for r := tile.row; r < tile.row+tile.span; r++ {
+			for c := tile.col; c < tile.col+tile.span; c++ {
+				cells[r][c] = tile.item.ID
+			}
+		}
+	}
+
+	lines := make([]string, grid.rows)
+	for r := range cells {
+		lines[r] = strings.Join(cells[r], " ")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestPackFeaturedGridWithoutFeatured(t *testing.T) {
+	defer withFeaturedOptions(0, 2, FeaturedByFirst, "")()
+
+	// Without featured tiles the order matches drawSquareGrid.
+	for n := 1; n <= 30; n++ {
+		for cols := 1; cols <= 8; cols++ {
+			items := newFeaturedItems(n)
+			grid := packFeaturedGrid(items, cols)
+
+			rows := ceilIntDivision(n, cols)
+			if grid.rows != rows || grid.cols != ceilIntDivision(n, rows) {
+				t.Errorf("%d items, %d cols: grid is %dx%d, want %dx%d", n, cols, grid.rows, grid.cols, rows, ceilIntDivision(n, rows))
+				continue
+			}
+
+			for i, tile := range grid.tiles {
+				if tile.row != i%rows || tile.col != i/rows {
+					t.Errorf("%d items, %d cols: item %d at %d,%d, want %d,%d", n, cols, i, tile.row, tile.col, i%rows, i/rows)
+				}
+			}
+		}
+	}
+}
+
+func TestPackFeaturedGrid(t *testing.T) {
+	tests := []struct {
+		n         int
+		cols      int
+		span      int
+		positions []int
+		rows      int
+		gridCols  int
+	}{
+		// 10 single tiles and one featured tile, which left a hole in the
+		// middle of the last row of a row by row packing.
+		{n: 11, cols: 5, span: 2, positions: []int{7}, rows: 3, gridCols: 5},
+		{n: 12, cols: 6, span: 2, positions: []int{0, 1}, rows: 3, gridCols: 6},
+		{n: 10, cols: 6, span: 3, positions: []int{0}, rows: 3, gridCols: 6},
+		{n: 2, cols: 3, span: 2, positions: []int{0, 1}, rows: 4, gridCols: 2},
+		{n: 1, cols: 5, span: 3, positions: []int{0}, rows: 3, gridCols: 3},
+	}
+
+	for _, test := range tests {
+		restore := withFeaturedOptions(len(test.positions), test.span, FeaturedByFirst, "")
+
+		items := newFeaturedItems(test.n, test.positions...)
+		grid := packFeaturedGrid(items, test.cols)
+		name := fmt.Sprintf("%d items, %d cols, featured %v", test.n, test.cols, test.positions)
+
+		if grid.rows != test.rows || grid.cols != test.gridCols {
+			t.Errorf("%s: grid is %dx%d, want %dx%d", name, grid.rows, grid.cols, test.rows, test.gridCols)
+		}
+
+		checkFeaturedGrid(t, name, items, grid, true)
+		restore()
+	}
+}
+
+func TestPackFeaturedGridLeavesNoInnerHoles(t *testing.T) {
+	for span := 2; span <= 3; span++ {
+		for count := 1; count <= 3; count++ {
+			restore := withFeaturedOptions(count, span, FeaturedByFirst, "")
+
+			for n := count; n <= 24; n++ {
+				for cols := 1; cols <= 8; cols++ {
+					// Featured tiles at the start, spread and at the end
+					layouts := [][]int{{}, {}, {}}
+					for i := 0; i < count; i++ {
+						layouts[0] = append(layouts[0], i)
+						layouts[1] = append(layouts[1], i*n/count)
+						layouts[2] = append(layouts[2], n-1-i)
+					}
+
+					for _, positions := range layouts {
+						items := newFeaturedItems(n, positions...)
+						name := fmt.Sprintf("span %d, %d items, %d cols, featured %v", span, n, cols, positions)
+
+						// A grid as narrow as a featured tile may leave no choice.
+						checkFeaturedGrid(t, name, items, packFeaturedGrid(items, cols), cols > span)
+					}
+				}
+			}
+
+			restore()
+		}
+	}
+}
+
+func TestTrimToCompleteFeaturedGrid(t *testing.T) {
+	defer withFeaturedOptions(1, 2, FeaturedByFirst, "")()
+
+	oldCols := gridCols
+	defer func() { gridCols = oldCols }()
+
+	gridCols = 5
+	items := trimToCompleteFeaturedGrid(newFeaturedItems(14, 0))
+
+	// 4 cells of the featured tile and 12 single tiles fill 4 rows
+	// of 4 columns.
+	if len(items) != 13 {
+		t.Errorf("trimmed to %d items, want 13", len(items))
+	}
+
+	if grid := packFeaturedGrid(items, gridCols); grid.holes != 0 {
+		t.Errorf("trimmed grid has %d empty cells\n%s", grid.holes, formatFeaturedGrid(grid))
+	}
+}
+
+func TestSelectFeatured(t *testing.T) {
+	tests := []struct {
+		count int
+		by    string
+		ids   string
+		want  string
+	}{
+		{count: 2, by: FeaturedByFirst, want: "a,c"},
+		{count: 2, by: FeaturedByPopular, want: "c,d"},
+		{count: 2, by: FeaturedByFirst, ids: "d, e,missing", want: "d,e"},
+		{count: 9, by: FeaturedByFirst, want: "a,c,d,e"},
+	}
+
+	for _, test := range tests {
+		restore := withFeaturedOptions(test.count, 2, test.by, test.ids)
+
+		items := []*MediaItem{
+			{ID: "a", Score: 1},
+			{ID: "b", Score: 9, Placeholder: true},
+			{ID: "c", Score: 5},
+			{ID: "d", Score: 5},
+			{ID: "e"},
+		}
+
+		selectFeatured(items)
+
+		var selected []string
+		for _, item := range items {
+			if item.Featured {
+				selected = append(selected, item.ID)
+			}
+		}
+
+		if got := strings.Join(selected, ","); got != test.want {
+			t.Errorf("%d by %s, ids %q: featured %s, want %s", test.count, test.by, test.ids, got, test.want)
+		}
+
+		restore()
+	}
+}
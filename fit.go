@@ -0,0 +1,224 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+)
+
+// fitSquareGrid returns the number of columns and the tile size at
+// which n square tiles cover most of the canvas. Featured tiles count
+// as the number of cells they cover, as they are chosen after the download.
+// With -complete-rows the tiles of an incomplete last row are dropped,
+// so fewer but larger tiles may cover more.
+func fitSquareGrid(n int) (int, int) {
+	bestCols, bestSize := 1, 1
+	bestCoverage := 0
+	minCols := 1
+
+	if featured > 0 {
+		minCols = featuredSpan
+	}
+
+	for cols := minCols; cols <= maxInt(n, minCols); cols++ {
+		tiles := n
+		if trimsRows() {
+			tiles = completeRowsCount(n, cols)
+		}
+
+		// Like drawSquareGrid, which fills the grid column by column.
+		rows := ceilIntDivision(tiles, cols)
+		used := ceilIntDivision(tiles, rows)
+
+		size := minInt(
+			(outputWidth-(used-1)*gridHSpacing)/used,
+			(outputHeight-(rows-1)*gridVSpacing)/rows,
+		)
+
+		if size < 1 {
+			continue
+		}
+
+		if coverage := tiles * size * size; coverage > bestCoverage {
+			bestCols, bestSize, bestCoverage = cols, size, coverage
+		}
+	}
+
+	return bestCols, bestSize
+}
+
+// fitFeaturedGrid returns the number of columns and the tile size at
+// which the packed featured grid covers most of the canvas.
+func fitFeaturedGrid(items []*MediaItem) (int, int) {
+	bestCols, bestSize := featuredSpan, 1
+	bestCoverage := 0
+
+	for cols := 1; cols <= featuredCells(len(items)); cols++ {
+		tiles := items
+		if trimsRows() {
+			tiles = items[:completeFeaturedCount(items, cols)]
+		}
+
+		grid := packFeaturedGrid(tiles, cols)
+
+		size := minInt(
+			(outputWidth-(grid.cols-1)*gridHSpacing)/grid.cols,
+			(outputHeight-(grid.rows-1)*gridVSpacing)/grid.rows,
+		)
+
+		if size < 1 {
+			continue
+		}
+
+		cells := grid.rows*grid.cols - grid.holes
+		if coverage := cells * size * size; coverage > bestCoverage {
+			bestCols, bestSize, bestCoverage = cols, size, coverage
+		}
+	}
+
+	return bestCols, bestSize
+}
+
+// fitNonSquareGrid returns the number of columns and the grid size at
+// which the items cover most of the canvas in drawNonSquareGrid.
+func fitNonSquareGrid(items []*MediaItem) (int, int) {
+	bestCols, bestSize := 1, 1
+	bestCoverage := 0.0
+
+	for cols := 1; cols <= len(items); cols++ {
+		tiles := items
+		if trimsRows() {
+			tiles = items[:completeRowsCount(len(items), cols)]
+		}
+
+		// Each row is as wide as the images' width w, so the height
+		// of all rows is the sum of w / aspect over the rows.
+		inverseAspects := 0.0
+
+		for start := 0; start < len(tiles); start += cols {
+			aspect := 0.0
+			for _, item := range tiles[start:minInt(start+cols, len(tiles))] {
+				aspect += aspectRatio(item)
+			}
+
+			inverseAspects += 1 / aspect
+		}
+
+		rows := ceilIntDivision(len(tiles), cols)
+		spacing := (cols - 1) * gridHSpacing
+
+		width := minInt(
+			outputWidth-spacing,
+			int(float64(outputHeight-(rows-1)*gridVSpacing)/inverseAspects),
+		)
+
+		size := (width - spacing) / cols
+		if size < 1 {
+			continue
+		}
+
+		// Width of the images with the chosen grid size
+		width = cols*size + spacing
+
+		if coverage := float64(width) * float64(width) * inverseAspects; coverage > bestCoverage {
+			bestCols, bestSize, bestCoverage = cols, size, coverage
+		}
+	}
+
+	return bestCols, bestSize
+}
+
+// fitJustifiedRows returns the target row height at which the rows of
+// the justified layout cover most of the canvas. Row breaks change with
+// the target, so a taller target doesn't necessarily cover more.
+func fitJustifiedRows(items []*MediaItem) int {
+	bestTarget, bestCoverage := 1, 0
+
+	for target := 1; target <= outputHeight; target++ {
+		rows := breakJustifiedRows(items, outputWidth, float64(target))
+		if justifiedHeight(rows) > outputHeight {
+			continue
+		}
+
+		coverage := 0
+		for _, row := range rows {
+			coverage += row.width * row.height
+		}
+
+		if coverage > bestCoverage {
+			bestTarget, bestCoverage = target, coverage
+		}
+	}
+
+	return bestTarget
+}
+
+// fitMasonryColumns returns the number of columns and the column width
+// at which the items cover most of the canvas.
+func fitMasonryColumns(items []*MediaItem) (int, int) {
+	bestCols, bestWidth := 1, 1
+	bestCoverage := 0
+
+	for cols := 1; cols <= len(items); cols++ {
+		width := (outputWidth - (cols-1)*gridHSpacing) / cols
+		if width < 1 {
+			break
+		}
+
+		columns, width := packMasonryToHeight(items, cols, width)
+
+		coverage := 0
+		for _, column := range columns {
+			coverage += width * (column.height - (len(column.items)-1)*gridVSpacing)
+		}
+
+		if coverage > bestCoverage {
+			bestCols, bestWidth, bestCoverage = cols, width, coverage
+		}
+	}
+
+	return bestCols, bestWidth
+}
+
+// trimsRows reports whether -complete-rows drops the tiles of an
+// incomplete last row, which only the grid layout has.
+func trimsRows() bool {
+	return completeRows && layout == LayoutGrid
+}
+
+// fitToCanvas chooses the grid size and columns for -limit tiles before
+// the images are fetched, so that images of the right size are requested.
+// Since the aspect ratios are unknown yet, square images are assumed.
+func fitToCanvas() {
+	gridCols, gridSize = fitSquareGrid(featuredCells(itemLimit))
+	rowHeight = gridSize
+
+	log.Printf("Fitting %d images into %d columns of %d pixels", itemLimit, gridCols, gridSize)
+}
+
+// fitLayout adapts the layout to the downloaded images, which may be
+// fewer than requested and have any aspect ratio.
+func fitLayout(items []*MediaItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	switch {
+	case layout == LayoutJustified:
+		rowHeight = fitJustifiedRows(items)
+		log.Printf("Fitting rows of %d pixels height", rowHeight)
+		return
+	case layout == LayoutMasonry:
+		gridCols, gridSize = fitMasonryColumns(items)
+	case squareTiles && featured > 0:
+		gridCols, gridSize = fitFeaturedGrid(items)
+	case squareTiles:
+		gridCols, gridSize = fitSquareGrid(len(items))
+	default:
+		gridCols, gridSize = fitNonSquareGrid(items)
+	}
+
+	log.Printf("Fitting %d images into %d columns of %d pixels", len(items), gridCols, gridSize)
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+// withFitOptions sets the canvas and grid options for a test and returns
+// a function restoring them.
+func withFitOptions(width, height, spacing int, complete bool) func() {
+	oldWidth, oldHeight := outputWidth, outputHeight
+	oldHSpacing, oldVSpacing := gridHSpacing, gridVSpacing
+	oldComplete, oldLayout := completeRows, layout
+
+	outputWidth, outputHeight = width, height
+	gridHSpacing, gridVSpacing = spacing, spacing
+	completeRows, layout = complete, LayoutGrid
+
+	return func() {
+		outputWidth, outputHeight = oldWidth, oldHeight
+		gridHSpacing, gridVSpacing = oldHSpacing, oldVSpacing
+		completeRows, layout = oldComplete, oldLayout
+	}
+}
+
+func TestCompleteRowsCount(t *testing.T) {
+	tests := []struct {
+		n, cols int
+		want    int
+	}{
+		{12, 4, 12},
+		{13, 4, 12},
+		{13, 5, 10},
+		{3, 5, 3},
+		{5, 5, 5},
+		{7, 1, 7},
+	}
+
+	for _, test := range tests {
+		if got := completeRowsCount(test.n, test.cols); got != test.want {
+			t.Errorf("completeRowsCount(%d, %d) = %d, want %d", test.n, test.cols, got, test.want)
+		}
+	}
+}
+
+func TestFitSquareGrid(t *testing.T) {
+	tests := []struct {
+		width, height, spacing int
+		complete               bool
+		n                      int
+		cols, size             int
+	}{
+		{2560, 1440, 0, false, 12, 4, 480},
+		{2560, 1440, 0, false, 13, 5, 480},
+		{1000, 1000, 10, false, 4, 2, 495},
+		{1000, 1000, 0, false, 1, 1, 1000},
+
+		// 13 tiles in 5 columns leave an incomplete row, while
+		// 12 tiles in 4 columns cover the most.
+		{2560, 1440, 0, true, 13, 4, 480},
+		{1000, 1000, 0, true, 5, 2, 500},
+
+		// The spacing leaves no room for the tiles.
+		{10, 10, 20, false, 4, 1, 1},
+	}
+
+	for _, test := range tests {
+		restore := withFitOptions(test.width, test.height, test.spacing, test.complete)
+		cols, size := fitSquareGrid(test.n)
+		restore()
+
+		if cols != test.cols || size != test.size {
+			t.Errorf("fitSquareGrid(%d) on %dx%d, spacing %d, complete %t = %d, %d, want %d, %d",
+				test.n, test.width, test.height, test.spacing, test.complete, cols, size, test.cols, test.size)
+		}
+	}
+}
+
+func TestFitFeaturedGrid(t *testing.T) {
+	defer withFeaturedOptions(1, 2, FeaturedByFirst, "")()
+
+	tests := []struct {
+		width, height int
+		complete      bool
+		n             int
+		positions     []int
+		cols, size    int
+	}{
+		// 9 cells fit into 3x3 cells of the square canvas.
+		{900, 900, false, 6, []int{0}, 3, 300},
+		{1600, 800, false, 5, []int{0}, 4, 400},
+		{900, 900, false, 5, []int{0}, 3, 300},
+
+		// 8 cells leave a hole in 3 columns. Dropping 2 tiles covers
+		// more than the 4 columns which fit all tiles.
+		{900, 900, true, 5, []int{0}, 3, 300},
+		{1600, 800, true, 5, []int{0}, 4, 400},
+	}
+
+	for _, test := range tests {
+		restore := withFitOptions(test.width, test.height, 0, test.complete)
+		items := newFeaturedItems(test.n, test.positions...)
+		cols, size := fitFeaturedGrid(items)
+
+		if cols != test.cols || size != test.size {
+			t.Errorf("fitFeaturedGrid(%d items) on %dx%d, complete %t = %d, %d, want %d, %d",
+				test.n, test.width, test.height, test.complete, cols, size, test.cols, test.size)
+		}
+
+		if test.complete {
+			if grid := packFeaturedGrid(items[:completeFeaturedCount(items, cols)], cols); grid.holes > 0 {
+				t.Errorf("fitFeaturedGrid(%d items) on %dx%d leaves %d empty cells", test.n, test.width, test.height, grid.holes)
+			}
+		}
+
+		restore()
+	}
+}
+
+func TestFitNonSquareGrid(t *testing.T) {
+	tests := []struct {
+		width, height int
+		complete      bool
+		sizes         [][2]int
+		cols, size    int
+	}{
+		{1000, 500, false, [][2]int{{200, 100}, {200, 100}, {200, 100}, {200, 100}}, 2, 500},
+		{1000, 1000, false, [][2]int{{100, 100}, {100, 100}, {100, 100}, {100, 100}}, 2, 500},
+
+		{1000, 500, false, [][2]int{{100, 100}, {100, 100}, {100, 100}}, 3, 333},
+
+		// 2 columns leave an incomplete row, but the complete
+		// one covers more than all 3 tiles.
+		{1000, 500, true, [][2]int{{100, 100}, {100, 100}, {100, 100}}, 2, 500},
+	}
+
+	for _, test := range tests {
+		items := make([]*MediaItem, len(test.sizes))
+		for i, size := range test.sizes {
+			items[i] = &MediaItem{Width: size[0], Height: size[1]}
+		}
+
+		restore := withFitOptions(test.width, test.height, 0, test.complete)
+		cols, size := fitNonSquareGrid(items)
+		restore()
+
+		if cols != test.cols || size != test.size {
+			t.Errorf("fitNonSquareGrid(%v) on %dx%d, complete %t = %d, %d, want %d, %d",
+				test.sizes, test.width, test.height, test.complete, cols, size, test.cols, test.size)
+		}
+	}
+}
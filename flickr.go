@@ -0,0 +1,336 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FlickrPageSize = 100
+)
+
+var (
+	FlickrSquareSizes = map[string]int{
+		"s": 75,
+		"q": 150,
+	}
+
+	// Sizes of the longest edge
+	FlickrSizes = map[string]int{
+		"t": 100,
+		"m": 240,
+		"n": 320,
+		"w": 400,
+		"z": 640,
+		"c": 800,
+		"b": 1024,
+		"h": 1600,
+		"k": 2048,
+	}
+)
+
+type FlickrAPI struct {
+	Key     string
+	BaseURL string
+}
+
+func (fa *FlickrAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	profileParts := strings.SplitN(options.Profile, ":", 2)
+	feature := profileParts[0]
+
+	profileURL, err := url.Parse(fa.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	q := profileURL.Query()
+
+	q.Set("api_key", fa.Key)
+	q.Set("format", "json")
+	q.Set("nojsoncallback", "1")
+
+	// Unknown features are reported by the switch below.
+	if (feature == "user" || feature == "group" || feature == "album") && len(profileParts) != 2 {
+		return nil, fmt.Errorf("Missing value in profile - %s:<value>", feature)
+	}
+
+	switch feature {
+	case "user":
+		userID, err := fa.findUserID(ctx, profileParts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		q.Set("method", "flickr.people.getPublicPhotos")
+		q.Set("user_id", userID)
+	case "group":
+		q.Set("method", "flickr.groups.pools.getPhotos")
+		q.Set("group_id", profileParts[1])
+	case "album":
+		if len(options.Tag) > 0 {
+			return nil, fmt.Errorf("Flickr albums don't support the tag filter")
+		}
+
+		q.Set("method", "flickr.photosets.getPhotos")
+		q.Set("photoset_id", profileParts[1])
+	case "interesting":
+		if len(options.Tag) > 0 {
+			return nil, fmt.Errorf("Flickr's interesting photos don't support the tag filter")
+		}
+
+		q.Set("method", "flickr.interestingness.getList")
+	case "search":
+		if len(options.Tag) == 0 {
+			return nil, fmt.Errorf("Flickr search requires a tag")
+		}
+
+		q.Set("method", "flickr.photos.search")
+	default:
+		return nil, fmt.Errorf("Unknown Flickr profile %q - use user, group, album, interesting or search", feature)
+	}
+
+	// Any tag filter requires the search method, users and groups
+	// are then passed as search restrictions.
+	if len(options.Tag) > 0 {
+		q.Set("method", "flickr.photos.search")
+		q.Set("tags", options.Tag)
+	}
+
+	// Request all sizes, the best one is chosen per photo since
+	// not every photo is available in every size.
+	extras := make([]string, 0, len(FlickrSizes)+len(FlickrSquareSizes))
+	for id := range FlickrSizes {
+		extras = append(extras, "url_"+id)
+	}
+
+	for id := range FlickrSquareSizes {
+		extras = append(extras, "url_"+id)
+	}
+
+	sort.Strings(extras)
+	extras = append(extras, "views")
+	q.Set("extras", strings.Join(extras, ","))
+	q.Set("per_page", strconv.Itoa(FlickrPageSize))
+
+	// Square sizes larger than Flickr's square variants are taken from
+	// the long edge sizes and cropped after downloading.
+	if options.Square && options.Size > FlickrSquareSizes["q"] {
+		log.Printf("Flickr's square images are at most %dpx, cropping larger images instead", FlickrSquareSizes["q"])
+	}
+
+	limit := options.Limit
+	items := make([]*MediaItem, 0, limit)
+
+	for page := 1; limit > 0; page++ {
+		q.Set("page", strconv.Itoa(page))
+
+		profileURL.RawQuery = q.Encode()
+
+		pageItems, pages, err := fa.fetchItemsForPage(ctx, profileURL.String(), options.Size, options.Square)
+		if err != nil {
+			return nil, err
+		}
+
+		// Remove any items over limit
+		if len(pageItems) > limit {
+			pageItems = pageItems[:limit]
+		}
+
+		items = append(items, pageItems...)
+		limit -= len(pageItems)
+
+		// API sources drained.
+		if page >= pages {
+			break
+		}
+	}
+
+	return items, nil
+}
+
+func (fa *FlickrAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+// findUserID resolves user names to Flickr's NSIDs. Values that
+// already are NSIDs, e.g. 12345678@N00, are returned as is.
+func (fa *FlickrAPI) findUserID(ctx context.Context, user string) (string, error) {
+	if strings.Contains(user, "@N") {
+		return user, nil
+	}
+
+	q := url.Values{}
+	q.Set("method", "flickr.people.findByUsername")
+	q.Set("api_key", fa.Key)
+	q.Set("username", user)
+	q.Set("format", "json")
+	q.Set("nojsoncallback", "1")
+
+	var result struct {
+		User *struct {
+			NSID string `json:"nsid"`
+		} `json:"user"`
+	}
+
+	if err := fa.get(ctx, fa.BaseURL+"?"+q.Encode(), &result); err != nil {
+		return "", err
+	}
+
+	if result.User == nil {
+		return "", fmt.Errorf("Flickr user %q not found", user)
+	}
+
+	return result.User.NSID, nil
+}
+
+// findBestSize returns the smallest size of the photo which is at least
+// as large as the requested size. Square tiles prefer the square variants,
+// if none of them is large enough a long edge size is used and the image
+// is cropped after downloading.
+// Returns an empty id if the photo isn't available in any size.
+func (fa *FlickrAPI) findBestSize(photo map[string]interface{}, size int, square bool) (string, bool) {
+	candidates := []map[string]int{FlickrSizes}
+
+	if square {
+		candidates = []map[string]int{FlickrSquareSizes, FlickrSizes}
+	}
+
+	for _, availableSizes := range candidates {
+		lastDiff := math.MaxInt32
+		var bestID string
+
+		for id, s := range availableSizes {
+			if len(jsonString(photo["url_"+id])) == 0 {
+				continue
+			}
+
+			if diff := s - size; diff >= 0 && diff < lastDiff {
+				lastDiff = diff
+				bestID = id
+			}
+		}
+
+		if len(bestID) > 0 {
+			return bestID, true
+		}
+	}
+
+	// Nothing large enough, use the largest available size.
+	var largestID string
+	largest := 0
+
+	for id, s := range FlickrSizes {
+		if len(jsonString(photo["url_"+id])) > 0 && s > largest {
+			largest = s
+			largestID = id
+		}
+	}
+
+	return largestID, len(largestID) > 0
+}
+
+func (fa *FlickrAPI) fetchItemsForPage(ctx context.Context, url string, size int, square bool) ([]*MediaItem, int, error) {
+	var media struct {
+		// Photosets are returned as "photoset", anything else as "photos"
+		Photos   *flickrPhotos `json:"photos"`
+		Photoset *flickrPhotos `json:"photoset"`
+	}
+
+	if err := fa.get(ctx, url, &media); err != nil {
+		return nil, 0, err
+	}
+
+	photos := media.Photos
+	if photos == nil {
+		photos = media.Photoset
+	}
+
+	if photos == nil {
+		return nil, 0, nil
+	}
+
+	mediaItems := make([]*MediaItem, 0, len(photos.Photo))
+
+	for _, photo := range photos.Photo {
+		id, ok := fa.findBestSize(photo, size, square)
+		if !ok {
+			continue
+		}
+
+		mediaItems = append(mediaItems, &MediaItem{
+			ID:     jsonString(photo["id"]),
+			URL:    jsonString(photo["url_"+id]),
+			Width:  jsonInt(photo["width_"+id]),
+			Height: jsonInt(photo["height_"+id]),
+			Score:  jsonInt(photo["views"]),
+		})
+	}
+
+	return mediaItems, jsonInt(photos.Pages), nil
+}
+
+// get requests a Flickr API method and decodes the response into v.
+func (fa *FlickrAPI) get(ctx context.Context, url string, v interface{}) error {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Flickr responded with %q", resp.Status)
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	// Errors are reported with status 200 and stat "fail".
+	var errInfo struct {
+		Stat    string `json:"stat"`
+		Message string `json:"message"`
+	}
+
+	if err := json.Unmarshal(body, &errInfo); err != nil {
+		return err
+	}
+
+	if errInfo.Stat == "fail" {
+		return errors.New(errInfo.Message)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
+
+type flickrPhotos struct {
+	// Flickr returns numbers as strings for some methods.
+	Pages interface{}              `json:"pages"`
+	Photo []map[string]interface{} `json:"photo"`
+}
+
+func NewFlickrAPI(key string) API {
+	return &FlickrAPI{key, "https://api.flickr.com/services/rest/"}
+}
+
+func init() {
+	apiFactory.Register("flickr", NewFlickrAPI)
+}
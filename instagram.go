@@ -5,14 +5,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 )
 
-const InstagramMediaLimit = 20
-
 type InstagramAPI struct {
 	BaseURL     string
 	thumbSizes  []int
@@ -20,46 +21,109 @@ type InstagramAPI struct {
 	urlSizeTpl  string
 }
 
-func (ia *InstagramAPI) FetchMediaItems(options APIFetchOptions) ([]*MediaItem, error) {
-	profileURL := fmt.Sprintf(ia.BaseURL, options.Profile)
-
-	resp, err := http.Get(profileURL)
+func (ia *InstagramAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	profileURL, err := url.Parse(fmt.Sprintf(ia.BaseURL, url.QueryEscape(options.Profile)))
 	if err != nil {
 		return nil, err
 	}
 
+	q := profileURL.Query()
+	limit := options.Limit
+	items := make([]*MediaItem, 0, limit)
+
+	for limit > 0 {
+		profileURL.RawQuery = q.Encode()
+
+		pageItems, maxID, err := ia.fetchItemsForPage(ctx, profileURL.String(), options.Size)
+		if err != nil {
+			return nil, err
+		}
+
+		// Remove any items over limit
+		if len(pageItems) > limit {
+			pageItems = pageItems[:limit]
+		}
+
+		items = append(items, pageItems...)
+		limit -= len(pageItems)
+
+		// API sources drained.
+		if len(maxID) == 0 {
+			break
+		}
+
+		q.Set("max_id", maxID)
+	}
+
+	return items, nil
+}
+
+// fetchItemsForPage returns the items of a page and the cursor of the
+// next page, which is empty if there are no more posts.
+func (ia *InstagramAPI) fetchItemsForPage(ctx context.Context, endPoint string, size int) ([]*MediaItem, string, error) {
+	resp, err := httpGet(ctx, endPoint)
+	if err != nil {
+		return nil, "", err
+	}
+
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Instagram responded with %q", resp.Status)
+	}
+
+	// Private or unknown profiles are answered with a HTML login page.
+	if contentType := resp.Header.Get("Content-Type"); len(contentType) > 0 && !strings.Contains(contentType, "json") {
+		return nil, "", fmt.Errorf("Instagram didn't return any media, the profile may be private or unknown")
+	}
+
 	var media struct {
-		Items []*struct {
-			ID     string `json:"id"`
-			Images *struct {
-				Thumbnail *struct {
-					URL string `json:"url"`
-				} `json:"thumbnail"`
-			} `json:"images"`
-		} `json:"items"`
+		Items         []*instagramPost `json:"items"`
+		MoreAvailable bool             `json:"more_available"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&media); err != nil {
-		return nil, err
+		return nil, "", fmt.Errorf("Failed to read Instagram media, %s", err.Error())
 	}
 
-	bestSize := ia.findBestSize(options.Size)
+	bestSize := ia.findBestSize(size)
 	bestSizeURLPart := fmt.Sprintf(ia.urlSizeTpl, bestSize, bestSize)
 
-	if options.Limit > InstagramMediaLimit {
-		return nil, fmt.Errorf("Instagram supporty only %d photos, limit too high", InstagramMediaLimit)
-	}
+	mediaItems := make([]*MediaItem, 0, len(media.Items))
+
+	for _, post := range media.Items {
+		// Carousels contain several photos or videos.
+		parts := []*instagramPost{post}
+		if len(post.CarouselMedia) > 0 {
+			parts = post.CarouselMedia
+		}
+
+		for i, part := range parts {
+			if part.Type == "video" || part.Images == nil || part.Images.Thumbnail == nil {
+				continue
+			}
+
+			id := post.ID
+			if len(post.CarouselMedia) > 0 {
+				id = fmt.Sprintf("%s_%d", post.ID, i)
+			}
+
+			mediaURL := ia.urlSizePart.ReplaceAllString(part.Images.Thumbnail.URL, bestSizeURLPart)
+			item := &MediaItem{ID: id, URL: mediaURL, Width: bestSize, Height: bestSize}
+			if post.Likes != nil {
+				item.Score = post.Likes.Count
+			}
 
-	mediaItems := make([]*MediaItem, 0, options.Limit)
+			mediaItems = append(mediaItems, item)
+		}
+	}
 
-	for _, item := range media.Items[:options.Limit] {
-		mediaURL := ia.urlSizePart.ReplaceAllString(item.Images.Thumbnail.URL, bestSizeURLPart)
-		mediaItems = append(mediaItems, &MediaItem{item.ID, mediaURL, bestSize, bestSize})
+	if !media.MoreAvailable || len(media.Items) == 0 {
+		return mediaItems, "", nil
 	}
 
-	return mediaItems, nil
+	// The next page starts after the last post.
+	return mediaItems, media.Items[len(media.Items)-1].ID, nil
 }
 
 func (ia *InstagramAPI) SupportsOnlySquareImages() bool {
@@ -77,6 +141,20 @@ func (ia *InstagramAPI) findBestSize(size int) int {
 	return ia.thumbSizes[len(ia.thumbSizes)-1]
 }
 
+type instagramPost struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Images *struct {
+		Thumbnail *struct {
+			URL string `json:"url"`
+		} `json:"thumbnail"`
+	} `json:"images"`
+	Likes *struct {
+		Count int `json:"count"`
+	} `json:"likes"`
+	CarouselMedia []*instagramPost `json:"carousel_media"`
+}
+
 func NewInstagramAPI(string) API {
 	return &InstagramAPI{
 		BaseURL:     "https://instagram.com/%s/media",
@@ -0,0 +1,335 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const JSONDefaultPageSize = 20
+
+// JSONMapping describes how to query a JSON endpoint and where to find
+// the media information in its responses. The URL and header values may
+// contain the placeholders {profile}, {tag}, {key}, {size}, {limit},
+// {page}, {offset} and {cursor}. Field paths are dot separated, array
+// elements are addressed by their index, e.g. "images.0.url".
+type JSONMapping struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Items   string            `json:"items"`
+	ID      string            `json:"id"`
+	Image   string            `json:"image"`
+	Width   string            `json:"width"`
+	Height  string            `json:"height"`
+	Score   string            `json:"score"`
+
+	Pagination struct {
+		// Type is either page, offset or cursor.
+		Type string `json:"type"`
+		// Start is the number of the first page, default is 1.
+		Start int `json:"start"`
+		// Size is the number of items per page.
+		Size int `json:"size"`
+		// Cursor is the field path of the next cursor.
+		Cursor string `json:"cursor"`
+	} `json:"pagination"`
+}
+
+type JSONAPI struct {
+	Key         string
+	MappingFile string
+}
+
+func (ja *JSONAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	mapping, err := ja.loadMapping()
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := mapping.Pagination.Size
+	if pageSize <= 0 {
+		pageSize = JSONDefaultPageSize
+	}
+
+	page := mapping.Pagination.Start
+	if page == 0 {
+		page = 1
+	}
+
+	vars := map[string]string{
+		"profile": options.Profile,
+		"tag":     options.Tag,
+		"key":     ja.Key,
+		"size":    strconv.Itoa(options.Size),
+		"limit":   strconv.Itoa(pageSize),
+		"offset":  "0",
+		"page":    strconv.Itoa(page),
+		"cursor":  "",
+	}
+
+	// A page with fewer entries than requested is the last one. If the
+	// URL doesn't request a page size, the endpoint uses its own.
+	sized := mapping.Pagination.Size > 0 || strings.Contains(mapping.URL, "{limit}")
+
+	items := make([]*MediaItem, 0, options.Limit)
+	seen := make(map[string]bool)
+
+	for len(items) < options.Limit {
+		pageItems, entries, cursor, err := ja.fetchItemsForPage(ctx, mapping, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		// API sources drained.
+		if entries == 0 {
+			break
+		}
+
+		added := 0
+
+		for _, item := range pageItems {
+			if len(items) == options.Limit {
+				break
+			}
+
+			// Endpoints ignoring the page or offset return the same items again.
+			if seen[item.ID] {
+				continue
+			}
+
+			seen[item.ID] = true
+			items = append(items, item)
+			added++
+		}
+
+		if added == 0 {
+			break
+		}
+
+		switch mapping.Pagination.Type {
+		case "page":
+			if sized && entries < pageSize {
+				return items, nil
+			}
+
+			page++
+			vars["page"] = strconv.Itoa(page)
+		case "offset":
+			if sized && entries < pageSize {
+				return items, nil
+			}
+
+			offset, _ := strconv.Atoi(vars["offset"])
+			vars["offset"] = strconv.Itoa(offset + entries)
+		case "cursor":
+			if len(cursor) == 0 || cursor == vars["cursor"] {
+				return items, nil
+			}
+
+			vars["cursor"] = cursor
+		default:
+			// Not paginated
+			return items, nil
+		}
+	}
+
+	return items, nil
+}
+
+func (ja *JSONAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+func (ja *JSONAPI) loadMapping() (*JSONMapping, error) {
+	if len(ja.MappingFile) == 0 {
+		return nil, fmt.Errorf("The json API requires a mapping file - pass -mapping <file>")
+	}
+
+	file, err := os.Open(ja.MappingFile)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	mapping := &JSONMapping{}
+	if err := json.NewDecoder(file).Decode(mapping); err != nil {
+		return nil, fmt.Errorf("Invalid mapping file %q, %s", ja.MappingFile, err.Error())
+	}
+
+	if len(mapping.URL) == 0 || len(mapping.ID) == 0 || len(mapping.Image) == 0 {
+		return nil, fmt.Errorf("Mapping file %q requires url, id and image", ja.MappingFile)
+	}
+
+	switch mapping.Pagination.Type {
+	case "", "page", "offset":
+	case "cursor":
+		if len(mapping.Pagination.Cursor) == 0 {
+			return nil, fmt.Errorf("Cursor pagination requires a cursor field path")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown pagination type %q", mapping.Pagination.Type)
+	}
+
+	return mapping, nil
+}
+
+// fetchItemsForPage returns the items of a page, the number of entries
+// in the page, including those without an ID or image, and the next cursor.
+func (ja *JSONAPI) fetchItemsForPage(ctx context.Context, mapping *JSONMapping, vars map[string]string) ([]*MediaItem, int, string, error) {
+	req, err := http.NewRequest("GET", expandJSONTemplate(mapping.URL, vars, true), nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	for name, value := range mapping.Headers {
+		req.Header.Set(name, expandJSONTemplate(value, vars, false))
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, "", fmt.Errorf("%q responded with %q", req.URL, resp.Status)
+	}
+
+	var body interface{}
+
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&body); err != nil {
+		return nil, 0, "", err
+	}
+
+	list, ok := lookupJSONPath(body, mapping.Items).([]interface{})
+	if !ok {
+		return nil, 0, "", fmt.Errorf("%q is not a list in the response", mapping.Items)
+	}
+
+	mediaItems := make([]*MediaItem, 0, len(list))
+
+	for _, entry := range list {
+		id := jsonString(lookupJSONPath(entry, mapping.ID))
+		imageURL := jsonString(lookupJSONPath(entry, mapping.Image))
+
+		if len(id) == 0 || len(imageURL) == 0 {
+			continue
+		}
+
+		// Resolve relative image URLs against the endpoint.
+		if u, err := req.URL.Parse(imageURL); err == nil {
+			imageURL = u.String()
+		}
+
+		// IDs are used as file names, so hash them like the feed GUIDs.
+		item := &MediaItem{ID: fmt.Sprintf("%x", sha1.Sum([]byte(id))), URL: imageURL}
+
+		if len(mapping.Width) > 0 && len(mapping.Height) > 0 {
+			item.Width = jsonInt(lookupJSONPath(entry, mapping.Width))
+			item.Height = jsonInt(lookupJSONPath(entry, mapping.Height))
+		}
+
+		if len(mapping.Score) > 0 {
+			item.Score = jsonInt(lookupJSONPath(entry, mapping.Score))
+		}
+
+		mediaItems = append(mediaItems, item)
+	}
+
+	var cursor string
+
+	if mapping.Pagination.Type == "cursor" {
+		cursor = jsonString(lookupJSONPath(body, mapping.Pagination.Cursor))
+	}
+
+	return mediaItems, len(list), cursor, nil
+}
+
+// expandJSONTemplate replaces all {name} placeholders of the template.
+// Values are escaped when used in URLs.
+func expandJSONTemplate(tpl string, vars map[string]string, escape bool) string {
+	pairs := make([]string, 0, len(vars)*2)
+
+	for name, value := range vars {
+		if escape {
+			value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+		}
+
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+
+	return strings.NewReplacer(pairs...).Replace(tpl)
+}
+
+// lookupJSONPath returns the value at the dot separated path
+// or nil if it doesn't exist. An empty path returns v itself.
+func lookupJSONPath(v interface{}, path string) interface{} {
+	if len(path) == 0 {
+		return v
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+
+	return v
+}
+
+func jsonString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	}
+
+	return ""
+}
+
+func jsonInt(v interface{}) int {
+	switch val := v.(type) {
+	case string:
+		i, _ := strconv.Atoi(val)
+		return i
+	case json.Number:
+		f, _ := val.Float64()
+		return int(f)
+	}
+
+	return 0
+}
+
+func NewJSONAPI(key string) API {
+	return &JSONAPI{key, mappingFile}
+}
+
+func init() {
+	apiFactory.Register("json", NewJSONAPI)
+}
@@ -0,0 +1,196 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLookupJSONPath(t *testing.T) {
+	var body interface{}
+
+	decoder := json.NewDecoder(strings.NewReader(`{
+		"data": {"photos": [{"id": 7, "urls": ["a.jpg", "b.jpg"]}]},
+		"name": "x"
+	}`))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"name", "x"},
+		{"data.photos.0.id", "7"},
+		{"data.photos.0.urls.1", "b.jpg"},
+		{"data.photos.1.id", ""},
+		{"data.photos.-1.id", ""},
+		{"data.photos.first.id", ""},
+		{"name.length", ""},
+		{"missing.path", ""},
+	}
+
+	for _, test := range tests {
+		if got := jsonString(lookupJSONPath(body, test.path)); got != test.want {
+			t.Errorf("lookupJSONPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	if got := lookupJSONPath(body, ""); got == nil {
+		t.Errorf("lookupJSONPath(\"\") = nil, want the body")
+	}
+}
+
+func TestExpandJSONTemplate(t *testing.T) {
+	vars := map[string]string{"profile": "a b/c", "page": "2"}
+
+	tests := []struct {
+		tpl    string
+		escape bool
+		want   string
+	}{
+		{"/albums/{profile}?page={page}", true, "/albums/a%20b%2Fc?page=2"},
+		{"Bearer {profile}", false, "Bearer a b/c"},
+		{"{unknown}", true, "{unknown}"},
+	}
+
+	for _, test := range tests {
+		if got := expandJSONTemplate(test.tpl, vars, test.escape); got != test.want {
+			t.Errorf("expandJSONTemplate(%q, %t) = %q, want %q", test.tpl, test.escape, got, test.want)
+		}
+	}
+}
+
+// newJSONTestServer serves pages of total photos. If repeat is set, the
+// page parameter is ignored and the first page is returned every time.
+func newJSONTestServer(total, pageSize int, repeat bool, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if repeat || page < 1 {
+			page = 1
+		}
+
+		photos := []map[string]interface{}{}
+		for i := (page - 1) * pageSize; i < minInt(page*pageSize, total); i++ {
+			photos = append(photos, map[string]interface{}{
+				"id":  fmt.Sprintf("../%d", i),
+				"url": fmt.Sprintf("/images/%d.jpg", i),
+			})
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"photos": photos})
+	}))
+}
+
+func writeJSONMapping(t *testing.T, dir, url string, size int) string {
+	mapping := fmt.Sprintf(`{
+		"url": %q,
+		"items": "photos",
+		"id": "id",
+		"image": "url",
+		"pagination": {"type": "page", "size": %d}
+	}`, url, size)
+
+	path := filepath.Join(dir, "mapping.json")
+	if err := ioutil.WriteFile(path, []byte(mapping), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestJSONAPIPagination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "photowall")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		total    int
+		repeat   bool
+		limit    int
+		items    int
+		requests int
+	}{
+		{"full pages", 12, false, 12, 12, 3},
+		{"short last page", 10, false, 20, 10, 3},
+		{"empty last page", 8, false, 20, 8, 3},
+		{"limit", 20, false, 6, 6, 2},
+		{"page ignored", 20, true, 20, 4, 2},
+	}
+
+	for _, test := range tests {
+		requests := 0
+		server := newJSONTestServer(test.total, 4, test.repeat, &requests)
+
+		api := &JSONAPI{MappingFile: writeJSONMapping(t, dir, server.URL+"/photos?page={page}&per_page={limit}", 4)}
+		items, err := api.FetchMediaItems(context.Background(), APIFetchOptions{Limit: test.limit})
+		server.Close()
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if len(items) != test.items || requests != test.requests {
+			t.Errorf("%s: %d items in %d requests, want %d in %d", test.name, len(items), requests, test.items, test.requests)
+		}
+	}
+}
+
+func TestJSONAPIItems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "photowall")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	requests := 0
+	server := newJSONTestServer(2, 4, false, &requests)
+	defer server.Close()
+
+	api := &JSONAPI{MappingFile: writeJSONMapping(t, dir, server.URL+"/api/photos?page={page}", 4)}
+
+	items, err := api.FetchMediaItems(context.Background(), APIFetchOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("%d items, want 2", len(items))
+	}
+
+	for i, item := range items {
+		// IDs like "../0" must not escape the cache directory.
+		if want := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("../%d", i)))); item.ID != want {
+			t.Errorf("item %d has ID %q, want %q", i, item.ID, want)
+		}
+
+		// Relative image URLs are resolved against the endpoint.
+		if want := fmt.Sprintf("%s/images/%d.jpg", server.URL, i); item.URL != want {
+			t.Errorf("item %d has URL %q, want %q", i, item.URL, want)
+		}
+	}
+}
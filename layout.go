@@ -0,0 +1,347 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// Layouts, see -layout
+const (
+	LayoutGrid      = "grid"
+	LayoutJustified = "justified"
+	LayoutMasonry   = "masonry"
+	LayoutMosaic    = "mosaic"
+)
+
+func parseLayoutOptions() {
+	switch layout {
+	case LayoutGrid, LayoutJustified, LayoutMasonry:
+	case LayoutMosaic:
+		parseMosaicOptions()
+	default:
+		fatalIf(fmt.Errorf("Unknown layout %q - use grid, justified, masonry or mosaic", layout))
+	}
+
+	if rowHeight < 0 {
+		fatalIf(fmt.Errorf("-row-height must not be negative"))
+	}
+
+	if rowHeight == 0 {
+		rowHeight = gridSize
+	}
+}
+
+// drawTile draws the image of the item into the rectangle. The image is
+// scaled, keeping its aspect ratio, to cover the rectangle and cropped
+// to its center.
+func drawTile(wp *image.RGBA, item *MediaItem, r image.Rectangle) {
+	img, err := openTileImage(item)
+	if err != nil {
+		fatalIf(fmt.Errorf("%s with image %s", err.Error(), item.ID))
+	}
+
+	draw.Draw(wp, r, coverImage(img, r.Dx(), r.Dy()), image.ZP, draw.Src)
+}
+
+// coverImage scales the image, keeping its aspect ratio, to cover the
+// given size and crops it to its center.
+func coverImage(img image.Image, width, height int) *image.RGBA {
+	if img.Bounds().Dx() != width || img.Bounds().Dy() != height {
+		scale := math.Max(float64(width)/float64(img.Bounds().Dx()), float64(height)/float64(img.Bounds().Dy()))
+		w := maxInt(int(math.Ceil(float64(img.Bounds().Dx())*scale)), width)
+		h := maxInt(int(math.Ceil(float64(img.Bounds().Dy())*scale)), height)
+
+		img = resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+	}
+
+	offset := image.Pt((img.Bounds().Dx()-width)/2, (img.Bounds().Dy()-height)/2)
+	cropped := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(cropped, cropped.Bounds(), img, img.Bounds().Min.Add(offset), draw.Src)
+
+	return cropped
+}
+
+func aspectRatio(item *MediaItem) float64 {
+	return float64(item.Width) / float64(item.Height)
+}
+
+// justifiedRow is a row of the justified layout. Its images are
+// width pixels wide in total, without spacing, at the given height.
+type justifiedRow struct {
+	items  []*MediaItem
+	aspect float64
+	width  int
+	height int
+}
+
+// breakJustifiedRows splits the items into rows which fill the width.
+// Like the line breaking of text, the sum of the squared differences
+// between the row heights and the target height is minimized over all
+// rows, instead of filling one row after another. The last row isn't
+// stretched beyond the target height.
+func breakJustifiedRows(items []*MediaItem, width int, target float64) []*justifiedRow {
+	n := len(items)
+
+	// cost[i] is the minimal cost of the items from i on, next[i]
+	// the start of the row following the row starting at i.
+	cost := make([]float64, n+1)
+	next := make([]int, n+1)
+
+	for i := n - 1; i >= 0; i-- {
+		cost[i] = math.Inf(1)
+		aspect := 0.0
+
+		for j := i; j < n; j++ {
+			aspect += aspectRatio(items[j])
+
+			available := width - (j-i)*gridHSpacing
+			if available <= 0 && j > i {
+				break
+			}
+
+			height := float64(maxInt(available, 1)) / aspect
+			diff := height - target
+
+			if j == n-1 && diff > 0 {
+				diff = 0
+			}
+
+			if c := diff*diff + cost[j+1]; c < cost[i] {
+				cost[i] = c
+				next[i] = j + 1
+			}
+
+			// Adding more images only flattens the row further.
+			if height < target/2 {
+				break
+			}
+		}
+	}
+
+	var rows []*justifiedRow
+
+	for i := 0; i < n; i = next[i] {
+		row := &justifiedRow{items: items[i:next[i]]}
+
+		for _, item := range row.items {
+			row.aspect += aspectRatio(item)
+		}
+
+		row.width = maxInt(width-(len(row.items)-1)*gridHSpacing, 1)
+		height := float64(row.width) / row.aspect
+
+		if next[i] == n && height > target {
+			height = target
+			row.width = int(height * row.aspect)
+		}
+
+		row.height = maxInt(int(height), 1)
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func justifiedHeight(rows []*justifiedRow) int {
+	height := (len(rows) - 1) * gridVSpacing
+	for _, row := range rows {
+		height += row.height
+	}
+
+	return height
+}
+
+// drawJustified draws the items in rows of varying length, each filling
+// the width of the wallpaper. If the rows exceed the height, the rows are
+// made narrower, and therefore lower, until they fit.
+func drawJustified(ctx context.Context, wp *image.RGBA, items []*MediaItem) {
+	width := outputWidth
+	rows := breakJustifiedRows(items, width, float64(rowHeight))
+
+	for justifiedHeight(rows) > outputHeight && width > 1 {
+		// Spacing doesn't scale, so this may take a few steps.
+		scale := float64(outputHeight) / float64(justifiedHeight(rows))
+		width = minInt(int(float64(width)*scale), width-1)
+
+		target := float64(rowHeight) * float64(width) / float64(outputWidth)
+		rows = breakJustifiedRows(items, width, target)
+	}
+
+	if width < outputWidth {
+		log.Printf("Reducing the row width to %d to fit the output size", width)
+	}
+
+	dy := (outputHeight - justifiedHeight(rows)) / 2
+
+	for _, row := range rows {
+		dx := (outputWidth - (row.width + (len(row.items)-1)*gridHSpacing)) / 2
+
+		// The last image absorbs the rounding errors, so that
+		// the row has exactly the computed width.
+		left := row.width
+
+		for i, item := range row.items {
+			exitIfCanceled(ctx)
+
+			w := int(float64(row.height) * aspectRatio(item))
+			if i == len(row.items)-1 {
+				w = left
+			}
+
+			w = maxInt(w, 1)
+
+			dp := image.Pt(dx, dy)
+			drawTile(wp, item, image.Rectangle{dp, dp.Add(image.Pt(w, row.height))})
+
+			dx += w + gridHSpacing
+			left -= w
+		}
+
+		dy += row.height + gridVSpacing
+	}
+}
+
+// masonryColumn is a column of the masonry layout.
+type masonryColumn struct {
+	items   []*MediaItem
+	heights []int
+	height  int
+}
+
+// packMasonryColumns places each item at the given column width into
+// the currently shortest column.
+func packMasonryColumns(items []*MediaItem, cols, width int) []*masonryColumn {
+	columns := make([]*masonryColumn, cols)
+	for i := range columns {
+		columns[i] = &masonryColumn{}
+	}
+
+	for _, item := range items {
+		shortest := columns[0]
+		for _, column := range columns[1:] {
+			if column.height < shortest.height {
+				shortest = column
+			}
+		}
+
+		h := maxInt(int(float64(width)/aspectRatio(item)), 1)
+
+		if len(shortest.items) > 0 {
+			shortest.height += gridVSpacing
+		}
+
+		shortest.items = append(shortest.items, item)
+		shortest.heights = append(shortest.heights, h)
+		shortest.height += h
+	}
+
+	return columns
+}
+
+func masonryHeight(columns []*masonryColumn) int {
+	height := 0
+	for _, column := range columns {
+		height = maxInt(height, column.height)
+	}
+
+	return height
+}
+
+// balanceMasonryColumns crops the images of each column, so that all
+// columns end at the height of the shortest one. The crop is spread over
+// the images of a column in proportion to their heights.
+func balanceMasonryColumns(columns []*masonryColumn) {
+	target := -1
+	for _, column := range columns {
+		if len(column.items) > 0 && (target < 0 || column.height < target) {
+			target = column.height
+		}
+	}
+
+	for _, column := range columns {
+		excess := column.height - target
+		if excess <= 0 {
+			continue
+		}
+
+		imagesHeight := column.height - (len(column.items)-1)*gridVSpacing
+		left := excess
+
+		for i := range column.heights {
+			crop := excess * column.heights[i] / imagesHeight
+			if i == len(column.heights)-1 {
+				crop = left
+			}
+
+			crop = minInt(crop, column.heights[i]-1)
+			column.heights[i] -= crop
+			column.height -= crop
+			left -= crop
+		}
+	}
+}
+
+// packMasonryToHeight packs the items into columns, which are narrowed
+// until they fit the height. It returns the columns and their width.
+func packMasonryToHeight(items []*MediaItem, cols, width int) ([]*masonryColumn, int) {
+	columns := packMasonryColumns(items, cols, width)
+
+	for masonryHeight(columns) > outputHeight && width > 1 {
+		// Spacing doesn't scale, so this may take a few steps.
+		scale := float64(outputHeight) / float64(masonryHeight(columns))
+		width = minInt(int(float64(width)*scale), width-1)
+		columns = packMasonryColumns(items, cols, width)
+	}
+
+	return columns, width
+}
+
+// drawMasonry draws the items in -cols columns of equal width, keeping
+// their aspect ratios. Each image is put into the currently shortest
+// column. If the columns exceed the height, they are narrowed until
+// they fit.
+func drawMasonry(ctx context.Context, wp *image.RGBA, items []*MediaItem) {
+	cols := minInt(gridCols, len(items))
+	columns, width := packMasonryToHeight(items, cols, gridSize)
+
+	if width < gridSize {
+		log.Printf("Reducing the column width to %d to fit the output size", width)
+	}
+
+	if balance {
+		balanceMasonryColumns(columns)
+	}
+
+	totalWidth := cols*(width+gridHSpacing) - gridHSpacing
+	dx := (outputWidth - totalWidth) / 2
+	baseDy := (outputHeight - masonryHeight(columns)) / 2
+
+	if dx < 0 {
+		log.Printf("Warning: columns exceed the output size, consider specifying a smaller grid size with --grid")
+	}
+
+	for _, column := range columns {
+		dy := baseDy
+
+		for i, item := range column.items {
+			exitIfCanceled(ctx)
+
+			dp := image.Pt(dx, dy)
+			drawTile(wp, item, image.Rectangle{dp, dp.Add(image.Pt(width, column.heights[i]))})
+
+			dy += column.heights[i] + gridVSpacing
+		}
+
+		dx += width + gridHSpacing
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type LocalAPI struct{}
+
+type localFile struct {
+	path string
+	rel  string
+	info os.FileInfo
+}
+
+type localFilesByModTime []*localFile
+
+func (l localFilesByModTime) Len() int      { return len(l) }
+func (l localFilesByModTime) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l localFilesByModTime) Less(i, j int) bool {
+	// Newest files first, just like the online photo streams.
+	return l[i].info.ModTime().After(l[j].info.ModTime())
+}
+
+func (la *LocalAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	root, err := filepath.Abs(options.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// A tag containing glob characters filters the file names, any
+	// other tag selects a sub folder of the profile directory.
+	pattern := ""
+	if isGlobPattern(options.Tag) {
+		pattern = options.Tag
+	} else if len(options.Tag) > 0 {
+		root = filepath.Join(root, options.Tag)
+	}
+
+	if info, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", root)
+	}
+
+	files, err := la.collectFiles(ctx, root, pattern, options.Recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Stable(localFilesByModTime(files))
+
+	mediaItems := make([]*MediaItem, 0, minInt(len(files), options.Limit))
+
+	for _, f := range files {
+		if len(mediaItems) == options.Limit {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		conf, err := decodeFileConfig(f.path)
+		if err != nil {
+			// Not an image or an unsupported format.
+			continue
+		}
+
+		mediaURL := &url.URL{Scheme: "file", Path: filepath.ToSlash(f.path)}
+
+		mediaItems = append(mediaItems, &MediaItem{
+			ID:     fmt.Sprintf("%x", sha1.Sum([]byte(f.rel))),
+			URL:    mediaURL.String(),
+			Width:  conf.Width,
+			Height: conf.Height,
+		})
+	}
+
+	return mediaItems, nil
+}
+
+func (la *LocalAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+func (la *LocalAPI) collectFiles(ctx context.Context, root, pattern string, recursive bool) ([]*localFile, error) {
+	var files []*localFile
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		// Large directory trees take a while.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if err != nil {
+			log.Printf("Error: Failed to read %q, %s", path, err.Error())
+			return nil
+		}
+
+		if info.IsDir() {
+			// Skip hidden directories and, unless requested,
+			// any sub directories.
+			if path != root && (!recursive || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if len(pattern) > 0 {
+			nameMatch, err := filepath.Match(pattern, info.Name())
+			if err != nil {
+				return err
+			}
+
+			relMatch, _ := filepath.Match(pattern, filepath.ToSlash(rel))
+
+			if !nameMatch && !relMatch {
+				return nil
+			}
+		}
+
+		files = append(files, &localFile{path, filepath.ToSlash(rel), info})
+		return nil
+	})
+
+	return files, err
+}
+
+func isGlobPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func decodeFileConfig(path string) (image.Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	defer file.Close()
+
+	conf, _, err := image.DecodeConfig(file)
+	return conf, err
+}
+
+func NewLocalAPI(string) API {
+	return &LocalAPI{}
+}
+
+func init() {
+	apiFactory.Register("local", NewLocalAPI)
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const LockFileName = "photowall.lock"
+
+// heldLock is the locked lock file of this run.
+var heldLock *os.File
+
+// errLockHeld is returned by lockFile if another process holds the lock.
+var errLockHeld = errors.New("lock is held by another process")
+
+// acquireLock makes sure that only one photowall run uses the data
+// directory at a time. The lock file is locked with the system's file
+// locks, which are released when the process dies, so a lock file left
+// behind by a crashed run doesn't block later runs.
+func acquireLock(dir string) error {
+	path := filepath.Join(dir, LockFileName)
+
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+
+		if err := lockFile(file); err != nil {
+			file.Close()
+
+			if err != errLockHeld {
+				return err
+			}
+
+			// The PID is informational only, it may not be written yet.
+			if pid, err := readLockPID(path); err == nil {
+				return fmt.Errorf("%q is in use by another photowall run (pid %d)", dir, pid)
+			}
+
+			return fmt.Errorf("%q is in use by another photowall run", dir)
+		}
+
+		// The previous owner may have removed the file between the open
+		// and the lock, in which case the lock protects nothing.
+		if locked, err := isSameFile(file, path); err != nil || !locked {
+			file.Close()
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := writeLockPID(file); err != nil {
+			file.Close()
+			return err
+		}
+
+		heldLock = file
+		return nil
+	}
+}
+
+func releaseLock() {
+	if heldLock == nil {
+		return
+	}
+
+	if err := unlockFile(heldLock); err != nil {
+		log.Printf("Error: Failed to remove lock %q, %s", heldLock.Name(), err.Error())
+	}
+
+	heldLock = nil
+}
+
+// isSameFile reports whether the open file is still the one at path.
+func isSameFile(file *os.File, path string) (bool, error) {
+	openInfo, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	pathInfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(openInfo, pathInfo), nil
+}
+
+func writeLockPID(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	return err
+}
+
+func readLockPID(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "photowall")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, LockFileName)
+
+	// Lock files left behind by crashed runs, whatever their content,
+	// are not locked and therefore taken over.
+	for _, content := range []string{"", "garbage", "99999999\n", strconv.Itoa(os.Getpid())} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := acquireLock(dir); err != nil {
+			t.Fatalf("acquireLock with leftover %q: %s", content, err)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+			t.Errorf("lock file contains %q, want the pid", data)
+		}
+
+		// The lock is held by this run now.
+		held := heldLock
+		heldLock = nil
+
+		if err := acquireLock(dir); err == nil {
+			t.Errorf("acquireLock succeeded while the lock is held")
+			releaseLock()
+		}
+
+		heldLock = held
+		releaseLock()
+
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("releaseLock left the lock file behind")
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile locks the file with flock without waiting.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLockHeld
+	}
+
+	return err
+}
+
+// unlockFile removes the lock file and releases the lock. The file is
+// removed before it is closed, so that nobody locks it while it is removed.
+func unlockFile(file *os.File) error {
+	err := os.Remove(file.Name())
+	file.Close()
+
+	return err
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAcquireLockHeldWithoutPID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "photowall")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Another run which has locked the file but not written its pid yet
+	file, err := os.Create(filepath.Join(dir, LockFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := acquireLock(dir); err == nil {
+		releaseLock()
+		t.Fatalf("acquireLock took over a held lock without pid")
+	}
+
+	if _, err := os.Stat(file.Name()); err != nil {
+		t.Errorf("held lock file was removed: %s", err)
+	}
+}
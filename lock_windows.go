@@ -0,0 +1,62 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// lockFile locks the first byte of the file with LockFileEx without
+// waiting.
+func lockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+
+	r, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r != 0 {
+		return nil
+	}
+
+	if err == errorLockViolation {
+		return errLockHeld
+	}
+
+	return err
+}
+
+// unlockFile releases the lock and removes the lock file. Windows
+// doesn't remove open files, so the file is closed first. If another
+// run opens it in between, the file is left to that run.
+func unlockFile(file *os.File) error {
+	file.Close()
+
+	if err := os.Remove(file.Name()); err != nil && !os.IsNotExist(err) && !isSharingViolation(err) {
+		return err
+	}
+
+	return nil
+}
+
+// isSharingViolation reports whether the file is opened by another process.
+func isSharingViolation(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == errorSharingViolation
+	}
+
+	return false
+}
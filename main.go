@@ -5,15 +5,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -34,31 +39,82 @@ const (
 	CacheDirName   = "cache"
 )
 
+// Handling of failed downloads, see -on-fail
+const (
+	FailSkip        = "skip"
+	FailBackfill    = "backfill"
+	FailPlaceholder = "placeholder"
+
+	// Minimum number of items fetched by each round of -on-fail
+	// backfill, in percent of -limit
+	BackfillPercent = 25
+)
+
 var (
 	// Flag vars
-	apiName       string
-	apiKey        string
-	profile       string
-	tag           string
-	baseDir       string
-	bgHex         string
-	bgPattern     string
-	outputSize    string
-	outputQuality int
-	squareTiles   bool
-	gridCols      int
-	gridSize      int
-	gridSpacing   string
-	itemLimit     int
-	showVersion   bool
+	apiName         string
+	apiKey          string
+	profile         string
+	tag             string
+	baseDir         string
+	bgHex           string
+	bgPattern       string
+	outputSize      string
+	outputQuality   int
+	squareTiles     bool
+	gridCols        int
+	gridSize        int
+	gridSpacing     string
+	itemLimit       int
+	recursive       bool
+	mappingFile     string
+	instance        string
+	sensitive       bool
+	sourceWeights   string
+	offline         bool
+	shuffle         bool
+	cacheMaxSize    string
+	cacheMaxBytes   int64
+	cacheMaxAge     time.Duration
+	keepWallpapers  int
+	downloadWorkers int
+	maxHostConns    int
+	connectTimeout  time.Duration
+	readTimeout     time.Duration
+	maxRetries      int
+	runTimeout      time.Duration
+	onFail          string
+	minSuccess      int
+	placeholderHex  string
+	overfetch       int
+	completeRows    bool
+	recordDir       string
+	replayDir       string
+	layout          string
+	rowHeight       int
+	balance         bool
+	fit             bool
+	featured        int
+	featuredBy      string
+	featuredIDs     string
+	featuredSpan    int
+	mosaicTarget    string
+	cellSize        int
+	mosaicReuse     int
+	tint            int
+	showVersion     bool
 
 	// Parsed values
-	outputWidth  int
-	outputHeight int
-	bgColor      color.RGBA
-	cacheDir     string
-	gridHSpacing int
-	gridVSpacing int
+	outputWidth      int
+	outputHeight     int
+	bgColor          color.RGBA
+	placeholderColor color.RGBA
+	cacheDir         string
+	targetImage      image.Image
+	gridHSpacing     int
+	gridVSpacing     int
+
+	sourceSpecList sourceSpecs
 
 	wallpaperName = fmt.Sprintf("wallpaper_%d.jpg", time.Now().Unix())
 
@@ -70,18 +126,36 @@ type MediaItem struct {
 	URL    string
 	Width  int
 	Height int
+
+	// Attribution, if provided by the API
+	Author    string
+	AuthorURL string
+
+	// Popularity of the image, like votes or likes, if provided by the API
+	Score int
+
+	// Source the item was fetched from
+	Source *Source
+
+	// Set if the download failed and a placeholder is drawn instead
+	Placeholder bool
+
+	// Set if the item spans several cells of the square grid
+	Featured bool
 }
 
 type APIFetchOptions struct {
-	Profile string
-	Size    int
-	Tag     string
-	Limit   int
-	Square  bool
+	Profile   string
+	Size      int
+	Tag       string
+	Limit     int
+	Square    bool
+	Recursive bool
+	Sensitive bool
 }
 
 type API interface {
-	FetchMediaItems(options APIFetchOptions) ([]*MediaItem, error)
+	FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error)
 	SupportsOnlySquareImages() bool
 }
 
@@ -106,8 +180,8 @@ func (a *APIFactory) Create(name, key string) API {
 }
 
 func init() {
-	flag.StringVar(&apiName, "api", "instagram", "API to use (instagram, tumblr)")
-	flag.StringVar(&apiKey, "key", "", "API key")
+	flag.StringVar(&apiName, "api", "instagram", "API to use (instagram, tumblr, 500px, flickr, unsplash, pexels, mastodon, reddit, local, rss, json)")
+	flag.StringVar(&apiKey, "key", "", "API key (format: <key> or <api>=<key>,<api>=<key>,...)")
 	flag.StringVar(&profile, "profile", "", "User profile name")
 	flag.StringVar(&tag, "tag", "", "Tag filter")
 	flag.StringVar(&baseDir, "dir", "", "Data directory")
@@ -118,21 +192,60 @@ func init() {
 	flag.StringVar(&gridSpacing, "spacing", "10", "Horizontal and vertical space between images (format: <all> or <horizontal>,<vertical>)")
 	flag.IntVar(&gridSize, "grid", 212.0, "Grid size")
 	flag.IntVar(&gridCols, "cols", 5, "Number of image columns")
+	flag.StringVar(&layout, "layout", LayoutGrid, "Layout of the images: grid, justified, masonry or mosaic")
+	flag.IntVar(&rowHeight, "row-height", 0, "Target row height of the justified layout, defaults to the grid size")
+	flag.BoolVar(&fit, "fit", false, "Choose grid size, columns and row height to fill the output size, overrides -grid, -cols and -row-height")
+	flag.IntVar(&featured, "featured", 0, "Number of images spanning several cells of the square grid")
+	flag.StringVar(&featuredBy, "featured-by", FeaturedByFirst, "Images to feature: first or popular")
+	flag.StringVar(&featuredIDs, "featured-ids", "", "Comma separated IDs of the images to feature, overrides -featured-by")
+	flag.IntVar(&featuredSpan, "featured-span", 2, "Number of cells per side of featured images: 2 or 3")
+	flag.StringVar(&mosaicTarget, "target", "", "Image reproduced by the mosaic layout")
+	flag.IntVar(&cellSize, "cell", 32, "Cell size of the mosaic layout in pixels")
+	flag.IntVar(&mosaicReuse, "reuse", 0, "Maximum number of cells per image in the mosaic layout, defaults to as few as possible")
+	flag.IntVar(&tint, "tint", 0, "Tint the mosaic images towards the cell colors, in percent")
+	flag.BoolVar(&balance, "balance", false, "Crop the images of the masonry layout so that all columns end at the same height")
 	flag.IntVar(&outputQuality, "q", 90, "Output jpeg quality (1-100)")
 	flag.IntVar(&itemLimit, "limit", 20, "Number of images fetched from api")
+	flag.BoolVar(&recursive, "recursive", false, "Include sub directories (local only)")
+	flag.StringVar(&mappingFile, "mapping", "", "Field mapping file (json only)")
+	flag.StringVar(&instance, "instance", "mastodon.social", "Instance to use (mastodon only)")
+	flag.BoolVar(&sensitive, "sensitive", false, "Include media marked as sensitive")
+	flag.Var(&sourceSpecList, "source", "Additional source, can be repeated (format: <api>:<profile>[#<tag>])")
+	flag.StringVar(&sourceWeights, "weights", "", "Comma separated weights of the sources (format: <w1>,<w2>,...)")
+	flag.BoolVar(&offline, "offline", false, "Build the wallpaper from cached images only")
+	flag.BoolVar(&shuffle, "shuffle", false, "Shuffle the images")
+	flag.StringVar(&cacheMaxSize, "cache-max-size", "", "Maximum cache size, least recently used images are removed first (e.g. 500MB)")
+	flag.DurationVar(&cacheMaxAge, "cache-max-age", 0, "Remove cached images unused for longer than this (e.g. 720h)")
+	flag.IntVar(&keepWallpapers, "keep-wallpapers", 0, "Number of wallpapers to keep, 0 keeps all")
+	flag.IntVar(&downloadWorkers, "workers", 8, "Number of concurrent downloads")
+	flag.IntVar(&maxHostConns, "host-conns", 4, "Maximum number of connections per host")
+	flag.DurationVar(&connectTimeout, "connect-timeout", 10*time.Second, "HTTP connect timeout")
+	flag.DurationVar(&readTimeout, "read-timeout", 30*time.Second, "HTTP read timeout")
+	flag.IntVar(&maxRetries, "retries", 3, "Number of retries of failed requests")
+	flag.DurationVar(&runTimeout, "timeout", 0, "Maximum runtime, e.g. 5m")
+	flag.StringVar(&onFail, "on-fail", FailSkip, "Handling of failed downloads: skip, backfill or placeholder")
+	flag.IntVar(&minSuccess, "min-success", 0, "Minimum percentage of successful downloads, otherwise the previous wallpaper is kept (it is always kept if all downloads fail)")
+	flag.StringVar(&placeholderHex, "placeholder-color", "#808080", "Color of placeholder tiles")
+	flag.IntVar(&overfetch, "overfetch", 0, "Additional images fetched to replace failed ones, in percent of -limit")
+	flag.BoolVar(&completeRows, "complete-rows", false, "Reduce the number of tiles so that all rows are complete")
+	flag.StringVar(&recordDir, "record", "", "Save all HTTP responses to this directory")
+	flag.StringVar(&replayDir, "replay", "", "Serve HTTP responses recorded with -record from this directory")
 	flag.BoolVar(&showVersion, "v", false, "Show version")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `Usage: %s -profile PROFILE [OPTIONS]
+       %s -source API:PROFILE[#TAG] [-source ...] [OPTIONS]
+       %s [OPTIONS] cache stats|prune [OPTIONS]
 
 By default photowall stores its cached images under ~/.photowall. If you
 want to change the cache directory pass -dir <your_dir>.
 
 Instagram:
 	To use instagram pass -api instagram. The Instagram API supports
-	only squared tiles and max 20 images. Since the API doesn't required
-	an API token you can use it without -key. Unfortunately the tag filter
-	is not available for Instagram.
+	only squared tiles. Since the API doesn't required an API token you
+	can use it without -key. Unfortunately the tag filter is not available
+	for Instagram. Videos are skipped and carousel posts are expanded into
+	multiple images.
 
 	photowall -profile linxspirationofficial
 
@@ -155,8 +268,169 @@ Tumblr:
 	For available global features and categories take a look at the API documentation
 	of 500px (https://github.com/500px/api-documentation/).
 
+Flickr:
+	To use flickr pass -api flickr -key api_key. Flickr requires an API key,
+	which you get at https://www.flickr.com/services/apps/create/. The profile
+	is one of user:<name>, group:<group_id>, album:<album_id>, interesting or
+	search. The tag filter works for everything but albums and is required
+	for search. Square and non-square tiles are supported.
+
+	photowall -api flickr -key api_key -profile group:34427469792@N01 -tag sunset
+
+Unsplash:
+	To use unsplash pass -api unsplash -key access_key. Register an app at
+	https://unsplash.com/developers to get an access key. The profile is one of
+	user:<username>, collection:<id> or search. Search requires a tag.
+
+	photowall -api unsplash -key access_key -profile collection:1065976
+
+Pexels:
+	To use pexels pass -api pexels -key api_key. Get an API key at
+	https://www.pexels.com/api/. The profile is one of user:<username>,
+	collection:<id>, curated or search. Search requires a tag, user profiles
+	are filtered from curated or search (with tag) results.
+
+	photowall -api pexels -key api_key -profile search -tag mountains
+
+Mastodon:
+	To use mastodon or pixelfed pass -api mastodon -instance <instance>. The
+	profile is either an account name or tag:<hashtag>. The tag option filters
+	the statuses by another hashtag. Media marked as sensitive is skipped unless
+	-sensitive is passed. Instances requiring authentication accept an access
+	token with -key.
+
+	photowall -api mastodon -instance pixelfed.social -profile tag:landscape
+
+Reddit:
+	To use reddit pass -api reddit -profile <subreddit>[:<sort>[:<time>]]. The
+	sort is one of hot (default), new, top, rising or controversial, the time
+	range (hour, day, week, month, year, all) applies to top and controversial.
+	The tag filters posts by flair. NSFW posts are skipped unless -sensitive
+	is passed. Galleries are expanded into multiple images.
+
+	photowall -api reddit -profile EarthPorn:top:week
+
+Local:
+	To use a local photo directory pass -api local -profile <dir>. Use -recursive
+	to include sub directories. The tag is either a glob pattern matched against
+	the file names, e.g. "*.jpg", or the name of a sub directory.
+
+	photowall -api local -profile ~/Pictures -recursive -tag "2016*"
+
+RSS:
+	To use a RSS 2.0, Atom or Media RSS feed pass -api rss -profile <feed_url>.
+	The profile may also be the path of a local feed file. Paged feeds are
+	followed until the limit is reached.
+
+	photowall -api rss -profile https://example.com/photos.rss
+
+JSON:
+	To use any JSON endpoint pass -api json -mapping <file>. The mapping file
+	describes the endpoint URL, the pagination and where to find the ID, URL,
+	width and height of each image. The profile, tag and key are inserted into
+	the URL template. See the README for the mapping format.
+
+	photowall -api json -mapping assets.json -profile holidays
+
+Layouts:
+	By default the images are arranged in a grid of -cols columns. Pass
+	-layout justified to fill each row with as many images as fit at
+	about -row-height pixels, like Flickr or Google Photos do. The rows
+	span the full width of -size and are narrowed if they don't fit
+	the height. -layout masonry puts the images into -cols columns of
+	-grid pixels width, each image into the currently shortest column.
+	Add -balance to crop the images so that all columns end evenly.
+
+	Pass -fit to let photowall choose -grid, -cols and -row-height so that
+	the images cover as much of -size as possible.
+
+	photowall -api reddit -profile EarthPorn -layout justified -row-height 180
+	photowall -api tumblr -profile photos.tumblr.com -layout masonry -balance
+	photowall -api reddit -profile EarthPorn -size 2560x1440 -limit 40 -fit
+
+Mosaic:
+	-layout mosaic reproduces the -target image with the fetched images.
+	The canvas is divided into cells of -cell pixels, each of which gets
+	the image closest to its average color. Every image fills at most
+	-reuse cells, by default as few as needed to cover the canvas. Use
+	-tint to shift the images towards the cell colors, in percent.
+
+	photowall -api reddit -profile EarthPorn -limit 200 -layout mosaic -target logo.png -cell 24 -tint 30
+
+Featured images:
+	Pass -featured N to let N images of the square grid span
+	-featured-span (2 or 3) cells per side, the other tiles flow around
+	them. -featured-by first features the first images, -featured-by
+	popular the ones with the most votes, likes or views, if the API
+	provides them. Pass -featured-ids to choose the images by their IDs.
+
+	photowall -api reddit -profile EarthPorn -square -featured 2 -featured-by popular
+	photowall -api unsplash -profile user:jondoe -square -featured-ids abc,def
+
+Multiple sources:
+	To combine several sources pass -source <api>:<profile>[#<tag>] for each
+	of them instead of -api, -profile and -tag. The sources are fetched
+	concurrently and their images interleaved. Use -weights to prefer some
+	sources, e.g. -weights 2,1 takes twice as many images from the first
+	source. Sources with fewer images leave their share to the others.
+	Different API keys are passed as -key <api>=<key>,<api>=<key>.
+
+	photowall -source "500px:user:jondoe#Animals" -source reddit:EarthPorn -weights 1,2
+
+Offline:
+	Pass -offline to build the wallpaper from the cached images of the
+	sources without contacting any API, e.g. when the network is down.
+	Combine it with -shuffle to get a fresh arrangement.
+
+	photowall -profile linxspirationofficial -offline -shuffle
+
+Failed downloads:
+	Use -overfetch to fetch additional images, in percent of -limit, which
+	replace failed downloads. Without spare images, tiles whose download
+	failed are skipped and the remaining tiles close the gap. Pass
+	-on-fail backfill to fetch further images from the sources once the
+	spares run out, or -on-fail placeholder to draw the tile in
+	-placeholder-color. -complete-rows drops the images of an incomplete
+	last row. If less than -min-success percent of the images were
+	downloaded no wallpaper is built, keeping the previous one. If all
+	downloads fail, the previous wallpaper is kept even with -min-success 0.
+
+	photowall -profile linxspirationofficial -on-fail backfill -min-success 80
+
+Record and replay:
+	Pass -record <dir> to save every HTTP response of the APIs and image
+	downloads to a directory. -replay <dir> serves these responses again
+	without any network access, which makes runs reproducible, e.g. to
+	debug layouts or to report bugs.
+
+	photowall -api reddit -profile EarthPorn -record ~/earthporn-rec
+	photowall -api reddit -profile EarthPorn -replay ~/earthporn-rec
+
+Cache:
+	After each run the cache is pruned: if -keep-wallpapers is set only the
+	newest wallpapers are kept, images unused for longer than -cache-max-age
+	are removed and, if the cache exceeds -cache-max-size, the least recently
+	used images are removed. Without these two policies images that are no
+	longer part of a source are removed right away. Use "cache prune" to
+	apply these policies without building a wallpaper and "cache stats"
+	to list the cached images per source.
+
+	photowall cache prune -cache-max-size 200MB -cache-max-age 720h
+
+Network:
+	Images are downloaded by -workers concurrent workers, with at most
+	-host-conns connections per host. Requests fail if connecting takes
+	longer than -connect-timeout or no data arrives within -read-timeout.
+	Network errors and server errors are retried up to -retries times with
+	an increasing delay. Rate limited requests wait until the limit resets.
+	Use -timeout to bound the whole run. On SIGINT or SIGTERM and when the
+	timeout expires photowall stops, removes incomplete files and exits
+	with status 130 or 124 respectively.
+
+	photowall -api 500px -profile user:mataneshel -limit 500 -workers 4
+
 Options:
-`, os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0])
 
 		flag.PrintDefaults()
 	}
@@ -167,6 +441,10 @@ func fatalIf(err error) {
 		return
 	}
 
+	// Errors after a cancellation are caused by it.
+	exitIfCanceled(shutdownCtx)
+
+	releaseLock()
 	log.Fatalf("Fatal: %s", err)
 }
 
@@ -201,24 +479,76 @@ func parseSizeOption() {
 }
 
 func parseBGOption() {
+	var err error
+
+	bgColor, err = parseHexColor(bgHex)
+	if err != nil {
+		fatalIf(fmt.Errorf("Background color not in hex format"))
+	}
+}
+
+func parseHexColor(hex string) (color.RGBA, error) {
 	// Remove leading hash
-	if strings.HasPrefix(bgHex, "#") {
-		bgHex = bgHex[1:]
+	if strings.HasPrefix(hex, "#") {
+		hex = hex[1:]
 	}
 
-	if len(bgHex) != 6 {
-		fatalIf(fmt.Errorf("Background color not in hex format"))
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("Color %q not in hex format", hex)
 	}
 
-	rgb, err := strconv.ParseInt(bgHex, 16, 0)
-	fatalIf(err)
+	rgb, err := strconv.ParseInt(hex, 16, 0)
+	if err != nil {
+		return color.RGBA{}, err
+	}
 
 	bitMask := int64(0xFF)
 
-	bgColor.R = uint8(rgb >> 16 & bitMask)
-	bgColor.G = uint8(rgb >> 8 & bitMask)
-	bgColor.B = uint8(rgb & bitMask)
-	bgColor.A = 255
+	return color.RGBA{
+		R: uint8(rgb >> 16 & bitMask),
+		G: uint8(rgb >> 8 & bitMask),
+		B: uint8(rgb & bitMask),
+		A: 255,
+	}, nil
+}
+
+func parseRecordOptions() {
+	if len(recordDir) > 0 && len(replayDir) > 0 {
+		fatalIf(fmt.Errorf("-record and -replay can't be combined"))
+	}
+
+	if len(recordDir) > 0 {
+		createDir(recordDir)
+	}
+
+	if len(replayDir) > 0 {
+		if info, err := os.Stat(replayDir); err != nil || !info.IsDir() {
+			fatalIf(fmt.Errorf("No recording found in %q", replayDir))
+		}
+	}
+}
+
+func parseFailureOptions() {
+	switch onFail {
+	case FailSkip, FailBackfill, FailPlaceholder:
+	default:
+		fatalIf(fmt.Errorf("Unknown -on-fail %q - use skip, backfill or placeholder", onFail))
+	}
+
+	if minSuccess < 0 || minSuccess > 100 {
+		fatalIf(fmt.Errorf("-min-success must be a percentage between 0 and 100"))
+	}
+
+	if overfetch < 0 {
+		fatalIf(fmt.Errorf("-overfetch must not be negative"))
+	}
+
+	var err error
+
+	placeholderColor, err = parseHexColor(placeholderHex)
+	if err != nil {
+		fatalIf(fmt.Errorf("Placeholder color not in hex format"))
+	}
 }
 
 func parseSpacingOption() {
@@ -264,8 +594,8 @@ func createDir(dir string) {
 	fatalIf(err)
 }
 
-func cachedImages() map[string]bool {
-	files, err := ioutil.ReadDir(cacheDir)
+func cachedImages(dir string) map[string]bool {
+	files, err := ioutil.ReadDir(dir)
 	fatalIf(err)
 
 	images := make(map[string]bool)
@@ -275,16 +605,15 @@ func cachedImages() map[string]bool {
 			continue
 		}
 
-		images[file.Name()] = true
+		// Metadata files count as part of their image.
+		images[cacheID(file.Name())] = true
 	}
 
 	return images
 }
 
-func openCachedImage(id string) (image.Image, error) {
-	imgFilePath := filepath.Join(cacheDir, id)
-
-	file, err := os.Open(imgFilePath)
+func openCachedImage(item *MediaItem) (image.Image, error) {
+	file, err := os.Open(item.cachePath())
 	if err != nil {
 		return nil, err
 	}
@@ -313,148 +642,515 @@ func cropImage(img image.Image) image.Image {
 	return cropped
 }
 
-func downloadImage(item *MediaItem) bool {
-	resp, err := http.Get(item.URL)
+// openMediaURL opens the image behind a media URL. Local files
+// are referenced with file:// URLs and read from disk, anything else
+// is downloaded.
+func openMediaURL(ctx context.Context, mediaURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(mediaURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "file" {
+		return os.Open(filepath.FromSlash(u.Path))
+	}
+
+	resp, err := httpGet(ctx, mediaURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// fetchMedia requests the image of the item. If meta is given the
+// request is conditional and notModified reports whether the cached
+// version is still up to date. The returned meta describes the response.
+func fetchMedia(ctx context.Context, item *MediaItem, meta *CacheMeta) (body io.ReadCloser, newMeta *CacheMeta, notModified bool, err error) {
+	newMeta = &CacheMeta{URL: item.URL, Fetched: time.Now()}
+
+	u, err := url.Parse(item.URL)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	// Local files are revalidated by their modification time.
+	if u.Scheme == "file" {
+		path := filepath.FromSlash(u.Path)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		newMeta.LastModified = info.ModTime().UTC().Format(http.TimeFormat)
+
+		if meta != nil && meta.LastModified == newMeta.LastModified {
+			return nil, newMeta, true, nil
+		}
+
+		file, err := os.Open(path)
+		return file, newMeta, false, err
+	}
+
+	req, err := http.NewRequest("GET", item.URL, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	// Recordings must contain the full responses.
+	if meta != nil && !recordingEnabled() {
+		if len(meta.ETag) > 0 {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+
+		if len(meta.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	newMeta.ETag = resp.Header.Get("ETag")
+	newMeta.LastModified = resp.Header.Get("Last-Modified")
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, newMeta, false, nil
+	case http.StatusNotModified:
+		resp.Body.Close()
+
+		// Servers may omit the validators in 304 responses.
+		if len(newMeta.ETag) == 0 {
+			newMeta.ETag = meta.ETag
+		}
+
+		if len(newMeta.LastModified) == 0 {
+			newMeta.LastModified = meta.LastModified
+		}
+
+		return nil, newMeta, true, nil
+	}
+
+	resp.Body.Close()
+	return nil, nil, false, fmt.Errorf("unexpected status %q", resp.Status)
+}
+
+// downloadImage downloads the image of the item into the cache. If meta
+// is given, the cached version is revalidated and only replaced if the
+// image changed. Returns the metadata of the cached image.
+func downloadImage(ctx context.Context, item *MediaItem, meta *CacheMeta) (*CacheMeta, bool) {
+	body, newMeta, notModified, err := fetchMedia(ctx, item, meta)
 	if err != nil {
 		log.Printf("Error: Failed to download %q, %s", item.URL, err.Error())
-		return false
+		return nil, false
+	}
+
+	if notModified {
+		newMeta.Width, newMeta.Height, newMeta.Hash = meta.Width, meta.Height, meta.Hash
+		newMeta.FileSize, newMeta.FileHash = meta.FileSize, meta.FileHash
+		log.Printf("%q not modified", item.ID)
+		return newMeta, true
 	}
 
-	defer resp.Body.Close()
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		log.Printf("Error: Failed to download %q, %s", item.URL, err.Error())
+		return nil, false
+	}
+
+	newMeta.Hash = fmt.Sprintf("%x", sha256.Sum256(data))
+
+	// Servers without validators deliver the full image every time,
+	// but it only needs to be replaced if the content changed.
+	if meta != nil && meta.Hash == newMeta.Hash {
+		newMeta.Width, newMeta.Height = meta.Width, meta.Height
+		newMeta.FileSize, newMeta.FileHash = meta.FileSize, meta.FileHash
+		log.Printf("%q unchanged", item.ID)
+		return newMeta, true
+	}
 
 	// Make sure it's jpeg
-	img, _, err := image.Decode(resp.Body)
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		log.Printf("Error: Reading image body of %q, %s", item.URL, err.Error())
-		return false
+		return nil, false
 	}
 
+	newMeta.Width = img.Bounds().Dx()
+	newMeta.Height = img.Bounds().Dy()
+
 	// If squared tiles are requested but image isn't then crop it first.
 	if squareTiles && img.Bounds().Dx() != img.Bounds().Dy() {
 		img = cropImage(img)
-		// Update the item information
-		item.Width = img.Bounds().Dx()
-		item.Height = img.Bounds().Dy()
 	}
 
-	// Create or truncate image file.
-	imgFilePath := filepath.Join(cacheDir, item.ID)
-	file, err := os.Create(imgFilePath)
+	// Some APIs, like feeds, don't know the image size in advance and
+	// those which resize the images may round the short edge differently.
+	item.Width = img.Bounds().Dx()
+	item.Height = img.Bounds().Dy()
+
+	var encoded bytes.Buffer
+
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{100}); err != nil {
+		log.Printf("Error: Saving image %q, %s", item.URL, err.Error())
+		return nil, false
+	}
+
+	// Remember size and hash of the cached file to detect corrupt files.
+	newMeta.FileSize = int64(encoded.Len())
+	newMeta.FileHash = fmt.Sprintf("%x", sha256.Sum256(encoded.Bytes()))
+
+	imgFilePath := item.cachePath()
+	err = writeFileAtomic(imgFilePath, func(w io.Writer) error {
+		_, err := encoded.WriteTo(w)
+		return err
+	})
+
 	if err != nil {
-		log.Printf("Error: Failed to open file for writing %q, %s", imgFilePath, err.Error())
-		return false
+		log.Printf("Error: Failed to write %q, %s", imgFilePath, err.Error())
+		return nil, false
 	}
 
-	defer file.Close()
+	log.Printf("Download of %q complete", item.ID)
+	return newMeta, true
+}
 
-	if err := jpeg.Encode(file, img, &jpeg.Options{100}); err != nil {
-		log.Printf("Error: Saving image %q, %s", item.URL, err.Error())
+// updateCacheMeta stores the metadata of the item's cached image
+// together with everything needed to restore the item offline.
+func updateCacheMeta(item *MediaItem, meta *CacheMeta, index int) bool {
+	meta.Index = index
+	meta.CachedWidth = item.Width
+	meta.CachedHeight = item.Height
+	meta.Author = item.Author
+	meta.AuthorURL = item.AuthorURL
+	meta.Score = item.Score
+
+	if err := saveCacheMeta(item, meta); err != nil {
+		log.Printf("Error: Failed to save metadata of %q, %s", item.ID, err.Error())
 		return false
 	}
 
-	log.Printf("Download of %q complete", item.ID)
 	return true
 }
 
+// checkCachedImage makes sure that the cached image has the correct size
+// and is complete. Images with metadata are verified by their size and
+// hash, images without metadata are decoded completely.
+func checkCachedImage(item *MediaItem, meta *CacheMeta) bool {
+	data, err := ioutil.ReadFile(item.cachePath())
+	if err != nil {
+		log.Printf("Could not open cached version of %q, %s", item.ID, err.Error())
+		return false
+	}
+
+	if meta != nil && len(meta.FileHash) > 0 {
+		if int64(len(data)) != meta.FileSize || fmt.Sprintf("%x", sha256.Sum256(data)) != meta.FileHash {
+			log.Printf("Error: Cached version of %q is incomplete or corrupt", item.ID)
+			return false
+		}
+	} else if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		log.Printf("Error: Cached version of %q is incomplete or corrupt, %s", item.ID, err.Error())
+		return false
+	}
+
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Error: Could not decode jpeg header of %q", item.ID)
+		return false
+	}
+
+	// Without size information any cached version is fine.
+	if item.Width == 0 || item.Height == 0 {
+		item.Width, item.Height = conf.Width, conf.Height
+		return true
+	}
+
+	if imageHasCorrectSize(&conf, item) {
+		item.Width, item.Height = conf.Width, conf.Height
+		return true
+	}
+
+	log.Printf("%q has wrong size", item.ID)
+	return false
+}
+
 func imageHasCorrectSize(iconf *image.Config, item *MediaItem) bool {
 	if squareTiles {
 		size := minInt(item.Width, item.Height)
 		return iconf.Height == size && iconf.Width == size
 	}
 
-	return iconf.Width == item.Width && iconf.Height == item.Height
+	// APIs which resize the images may round the short edge differently.
+	return absInt(iconf.Width-item.Width) <= 1 && absInt(iconf.Height-item.Height) <= 1
 }
 
-func removeItem(items []*MediaItem, item *MediaItem) []*MediaItem {
-	for i, it := range items {
-		if it == item {
-			return append(items[:i], items[i+1:]...)
+// downloadImages downloads the images of the first count items. Items
+// beyond count are spares which replace failed downloads. Once they run
+// out, more is called with the known items and the number of missing
+// ones to fetch further items, until it returns none. more is nil unless
+// -on-fail is backfill. The remaining failed tiles are handled according
+// to -on-fail. It returns the items to draw and the number of successful
+// downloads.
+func downloadImages(ctx context.Context, items []*MediaItem, count int, more func([]*MediaItem, int) []*MediaItem) ([]*MediaItem, int) {
+	var dls sync.WaitGroup
+
+	// Each source has its own cache namespace, so only
+	// the namespaces of the fetched sources are touched.
+	caches := make(map[string]map[string]bool)
+
+	// isCached checks if the image is cached. If it is then it's removed
+	// from the cache info. Anything left in the cache after the downloads
+	// is deprecated.
+	isCached := func(item *MediaItem) bool {
+		dir := item.Source.CacheDir
+
+		if caches[dir] == nil {
+			caches[dir] = cachedImages(dir)
+			log.Printf("Found %d cached images for %s", len(caches[dir]), item.Source)
 		}
+
+		cached := caches[dir][item.ID]
+		delete(caches[dir], item.ID)
+
+		return cached
 	}
 
-	return items
-}
+	cachedItems := make([]bool, len(items))
 
-func downloadImages(items []*MediaItem) {
-	var dls sync.WaitGroup
-	var mutex sync.Mutex
-	var failedItems []*MediaItem
+	for index, item := range items {
+		cachedItems[index] = isCached(item)
+	}
 
-	cache := cachedImages()
-	log.Printf("Found %d cached images", len(cache))
+	// Each tile of the wallpaper is a slot, which holds the index
+	// of its item. Backfilling replaces the item of a failed slot.
+	count = minInt(count, len(items))
+	slots := make([]int, count)
+	succeeded := make([]bool, count)
 
-	for _, item := range items {
-		// Check if the image is cached. If it is then remove
-		// it from the cache info. Anything left in the cache after
-		// the loop is deprecated.
-		cached := cache[item.ID]
+	download := func(slot int) {
+		index := slots[slot]
+		item := items[index]
+
+		var meta *CacheMeta
+
+		if cachedItems[index] {
+			log.Printf("Checking cached image %q", item.ID)
+
+			m, err := loadCacheMeta(item)
+			if err != nil {
+				m = nil
+			}
 
-		if cached {
-			delete(cache, item.ID)
+			// Only intact images fetched from the same URL are revalidated,
+			// anything else is downloaded again.
+			if checkCachedImage(item, m) && m != nil && m.URL == item.URL {
+				meta = m
+			}
 		}
 
-		dls.Add(1)
+		if meta != nil {
+			log.Printf("Revalidating cached image %q", item.ID)
+		} else {
+			log.Printf("Downloading new version of %q", item.ID)
+		}
 
-		go func(item *MediaItem, cached bool) {
-			defer dls.Done()
+		newMeta, ok := downloadImage(ctx, item, meta)
+		if ok {
+			ok = updateCacheMeta(item, newMeta, slot)
+		}
 
-			if cached {
-				log.Printf("Checking cached image %q", item.ID)
+		succeeded[slot] = ok
+	}
 
-				// Make sure that the image has the correct size and is not broken
-				file, err := os.Open(filepath.Join(cacheDir, item.ID))
-				if err != nil {
-					log.Printf("Could not open cached version of %q, %s", item.ID, err.Error())
-					goto downloadImage
-				}
+	pending := make([]int, count)
+	for slot := range slots {
+		slots[slot] = slot
+		pending[slot] = slot
+	}
 
-				defer file.Close()
-				conf, _, err := image.DecodeConfig(file)
-				if err != nil {
-					log.Printf("Error: Could not decode jpeg header of %q", item.ID)
-					goto downloadImage
-				}
+	next := count
 
-				if imageHasCorrectSize(&conf, item) {
-					return
+	for len(pending) > 0 {
+		// Download with a limited number of workers.
+		jobs := make(chan int)
+
+		for w := 0; w < maxInt(downloadWorkers, 1); w++ {
+			dls.Add(1)
+
+			go func() {
+				defer dls.Done()
+
+				for slot := range jobs {
+					download(slot)
 				}
+			}()
+		}
 
-				log.Printf("%q has wrong size", item.ID)
+		// Stop handing out work once the run is canceled, downloads
+		// in progress are aborted by the context.
+	dispatch:
+		for _, slot := range pending {
+			select {
+			case jobs <- slot:
+			case <-ctx.Done():
+				break dispatch
 			}
+		}
 
-		downloadImage:
-			log.Printf("Downloading new version of %q", item.ID)
-			if !downloadImage(item) {
-				// If the download failed we remember the item
-				// in order to remove it later.
-				mutex.Lock()
-				failedItems = append(failedItems, item)
-				mutex.Unlock()
+		close(jobs)
+		dls.Wait()
+		exitIfCanceled(ctx)
+
+		var failed []int
+
+		for _, slot := range pending {
+			if !succeeded[slot] {
+				failed = append(failed, slot)
 			}
+		}
+
+		// Fetch more items once the spares run out.
+		if missing := len(failed) - (len(items) - next); missing > 0 && more != nil {
+			// Fewer items than requested mean the sources are drained.
+			moreItems := more(items, missing)
+			if len(moreItems) < missing {
+				log.Printf("No more images to backfill %d failed downloads", missing-len(moreItems))
+				more = nil
+			}
+
+			for _, item := range moreItems {
+				items = append(items, item)
+				cachedItems = append(cachedItems, isCached(item))
+			}
+		}
 
-		}(item, cached)
+		// Retry failed slots with the next spare items.
+		pending = nil
+
+		for _, slot := range failed {
+			if next == len(items) {
+				break
+			}
+
+			log.Printf("Replacing %q with %q", items[slots[slot]].ID, items[next].ID)
+			slots[slot] = next
+			next++
+
+			pending = append(pending, slot)
+		}
 	}
 
-	dls.Wait()
+	// Remove deprecated images and their metadata. With a cache policy
+	// they are kept and left to the pruning, which removes them once
+	// they're too old or the cache is too large.
+	if cacheMaxBytes == 0 && cacheMaxAge == 0 {
+		for dir, cache := range caches {
+			for id, _ := range cache {
+				imgFilePath := filepath.Join(dir, id)
+
+				log.Printf("Removing old image %q", imgFilePath)
 
-	// Remove deprecated images
-	for file, _ := range cache {
-		imgFilePath := filepath.Join(cacheDir, file)
+				for _, path := range []string{imgFilePath, imgFilePath + CacheMetaSuffix} {
+					if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+						log.Printf("Error: Failed to remove old file %q, %s", path, err.Error())
+					}
+				}
+			}
+		}
+	}
 
-		log.Printf("Removing old image %q", imgFilePath)
+	tiles := make([]*MediaItem, 0, count)
+	downloaded := 0
 
-		if err := os.Remove(imgFilePath); err != nil {
-			log.Printf("Error: Failed to remove old file %q, %s", imgFilePath, err.Error())
+	for slot, index := range slots {
+		item := items[index]
+
+		switch {
+		case succeeded[slot]:
+			downloaded++
+		case onFail == FailPlaceholder:
+			item.Placeholder = true
+
+			// Square placeholders for items of unknown size
+			if squareTiles || item.Width == 0 || item.Height == 0 {
+				item.Width, item.Height = gridSize, gridSize
+			}
+		default:
+			// Skipped, the remaining tiles flow into the gap.
+			continue
 		}
+
+		tiles = append(tiles, item)
+	}
+
+	return tiles, downloaded
+}
+
+// checkMinSuccess fails the run if fewer than -min-success percent of the
+// attempted images were downloaded. The wallpaper isn't built then, so the
+// previous one is kept.
+func checkMinSuccess(downloaded, attempted int) {
+	if downloaded == 0 {
+		fatalIf(fmt.Errorf("All %d downloads failed, keeping the previous wallpaper", attempted))
+	}
+
+	if downloaded*100 < attempted*minSuccess {
+		fatalIf(fmt.Errorf("Only %d of %d images downloaded, below -min-success %d%%, keeping the previous wallpaper", downloaded, attempted, minSuccess))
+	}
+
+	if downloaded < attempted {
+		log.Printf("Warning: %d of %d downloads failed", attempted-downloaded, attempted)
+	}
+}
+
+// trimToCompleteRows drops the items of an incomplete last row, unless
+// there is only a single row.
+func trimToCompleteRows(items []*MediaItem) []*MediaItem {
+	complete := completeRowsCount(len(items), gridCols)
+
+	if complete < len(items) {
+		log.Printf("Dropping %d images to complete the last row", len(items)-complete)
+		items = items[:complete]
+	}
+
+	return items
+}
+
+// completeRowsCount returns the number of n tiles in complete rows of
+// cols tiles, or n if they don't fill a single row.
+func completeRowsCount(n, cols int) int {
+	if complete := n - n%cols; complete > 0 {
+		return complete
 	}
 
-	// Remove failed items
-	for _, item := range failedItems {
-		items = removeItem(items, item)
+	return n
+}
+
+// openTileImage returns the image of a tile. Placeholders of failed
+// downloads are filled with the placeholder color.
+func openTileImage(item *MediaItem) (image.Image, error) {
+	if !item.Placeholder {
+		return openCachedImage(item)
 	}
+
+	img := image.NewRGBA(image.Rect(0, 0, item.Width, item.Height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{placeholderColor}, image.ZP, draw.Src)
+
+	return img, nil
 }
 
-func drawSquareGrid(wp *image.RGBA, items []*MediaItem) {
+func drawSquareGrid(ctx context.Context, wp *image.RGBA, items []*MediaItem) {
 	// Compute number of rows and columns as well as the offset to
 	// center the grid.
 	//
@@ -475,7 +1171,9 @@ func drawSquareGrid(wp *image.RGBA, items []*MediaItem) {
 	}
 
 	for _, item := range items {
-		img, err := openCachedImage(item.ID)
+		exitIfCanceled(ctx)
+
+		img, err := openTileImage(item)
 		if err != nil {
 			fatalIf(fmt.Errorf("%s with image %s", err.Error(), item.ID))
 		}
@@ -510,7 +1208,7 @@ func drawSquareGrid(wp *image.RGBA, items []*MediaItem) {
 
 }
 
-func drawNonSquareGrid(wp *image.RGBA, items []*MediaItem) {
+func drawNonSquareGrid(ctx context.Context, wp *image.RGBA, items []*MediaItem) {
 	cols := gridCols
 	rows := ceilIntDivision(len(items), cols)
 
@@ -552,7 +1250,9 @@ func drawNonSquareGrid(wp *image.RGBA, items []*MediaItem) {
 	rowWidth := 0
 	row, col = 0, 0
 	for i, item := range items {
-		img, err := openCachedImage(item.ID)
+		exitIfCanceled(ctx)
+
+		img, err := openTileImage(item)
 		fatalIf(err)
 
 		h := desiredHeights[row]
@@ -615,7 +1315,7 @@ func drawBackgroundPattern(wp *image.RGBA) {
 	}
 }
 
-func buildWallpaper(items []*MediaItem) {
+func buildWallpaper(ctx context.Context, items []*MediaItem) {
 	log.Printf("Building wallpaper (%s)", outputSize)
 
 	// Create wallpaper canvas and draw the background color.
@@ -628,18 +1328,27 @@ func buildWallpaper(items []*MediaItem) {
 	}
 
 	// Choose drawing algorithm
-	if squareTiles {
-		drawSquareGrid(wp, items)
-	} else {
-		drawNonSquareGrid(wp, items)
+	switch {
+	case layout == LayoutJustified:
+		drawJustified(ctx, wp, items)
+	case layout == LayoutMasonry:
+		drawMasonry(ctx, wp, items)
+	case layout == LayoutMosaic:
+		drawMosaic(ctx, wp, items)
+	case squareTiles && featured > 0:
+		drawFeaturedGrid(ctx, wp, items)
+	case squareTiles:
+		drawSquareGrid(ctx, wp, items)
+	default:
+		drawNonSquareGrid(ctx, wp, items)
 	}
 
-	wpFile := filepath.Join(cacheDir, wallpaperName)
-	file, err := os.Create(wpFile)
-	fatalIf(err)
+	exitIfCanceled(ctx)
 
-	defer file.Close()
-	fatalIf(jpeg.Encode(file, wp, &jpeg.Options{Quality: outputQuality}))
+	wpFile := filepath.Join(cacheDir, wallpaperName)
+	fatalIf(writeFileAtomic(wpFile, func(w io.Writer) error {
+		return jpeg.Encode(w, wp, &jpeg.Options{Quality: outputQuality})
+	}))
 }
 
 func main() {
@@ -651,50 +1360,134 @@ func main() {
 		return
 	}
 
-	requiredOption("profile", profile)
+	parseRecordOptions()
+	setupHTTPClient()
+
+	// Sub commands
+	if flag.NArg() > 0 {
+		runCacheCommand(flag.Args())
+		return
+	}
+
+	sources := parseSourceOptions()
 
 	parseSizeOption()
 	parseBGOption()
 	parseSpacingOption()
+	parseFailureOptions()
+	parseCacheOptions()
+	parseLayoutOptions()
 	fallbackDirOption()
 
-	api := apiFactory.Create(apiName, apiKey)
-	if api == nil {
-		fatalIf(fmt.Errorf("%q API not supported", apiName))
-	}
+	// Check if the apis support non-square tiles
+	reconcileSquareTiles(sources)
+	parseFeaturedOptions()
 
-	// Check if the api supports non-square tiles
-	if !squareTiles && api.SupportsOnlySquareImages() {
-		log.Printf("The %q API supports only square tiles - falling back", apiName)
-		squareTiles = true
+	// The grid size determines the size of the fetched images.
+	if fit {
+		fitToCanvas()
 	}
 
 	// Create the photo and wallpaper directory.
 	createDir(baseDir)
 
+	// Make sure no other run uses the same directory.
+	fatalIf(acquireLock(baseDir))
+	defer releaseLock()
+
+	// Stop gracefully on signals and after the timeout.
+	ctx, cancel := setupShutdown(runTimeout)
+	defer cancel()
+
 	cacheDir = filepath.Join(baseDir, CacheDirName)
 	createDir(cacheDir)
+	removeTempFiles(cacheDir)
+	setupCacheNamespaces(sources)
 
-	// Request recent profile media
-	items, err := api.FetchMediaItems(APIFetchOptions{
-		Profile: profile,
-		Size:    gridSize,
-		Tag:     tag,
-		Limit:   itemLimit,
-		Square:  squareTiles,
-	})
-	fatalIf(err)
+	var items []*MediaItem
 
-	if l := len(items); l == 0 {
-		log.Printf("Nothing to do")
-		return
+	if offline {
+		// Restore the items from the cache
+		items = loadCachedSources(sources, itemLimit)
+		log.Printf("Restored %d media items from cache", len(items))
 	} else {
-		log.Printf("Fetched %d media items", l)
+		// Fetch spare items to replace failed downloads.
+		fetchLimit := itemLimit
+		if overfetch > 0 {
+			fetchLimit += ceilIntDivision(itemLimit*overfetch, 100)
+		}
+
+		fetchOptions := APIFetchOptions{
+			Size:      gridSize,
+			Limit:     fetchLimit,
+			Square:    squareTiles,
+			Recursive: recursive,
+			Sensitive: sensitive,
+		}
+
+		// Request recent profile media
+		var err error
+		items, err = fetchSources(ctx, sources, fetchOptions)
+		fatalIf(err)
+
+		if l := len(items); l == 0 {
+			log.Printf("Nothing to do")
+			return
+		} else {
+			log.Printf("Fetched %d media items", l)
+		}
+
+		// Download images
+		attempted := minInt(itemLimit, len(items))
+
+		// Fetch further items once the spares run out.
+		var more func([]*MediaItem, int) []*MediaItem
+
+		if onFail == FailBackfill {
+			more = func(known []*MediaItem, missing int) []*MediaItem {
+				fetchOptions.Limit = len(known) + maxInt(missing, ceilIntDivision(itemLimit*BackfillPercent, 100))
+				return fetchMoreItems(ctx, sources, fetchOptions, known)
+			}
+		}
+
+		var downloaded int
+		items, downloaded = downloadImages(ctx, items, itemLimit, more)
+		checkMinSuccess(downloaded, attempted)
+	}
+
+	if featured > 0 {
+		selectFeatured(items)
 	}
 
-	// Download images
-	downloadImages(items)
+	if shuffle {
+		shuffleItems(items)
+	}
+
+	// Adapt the layout to the number and aspect ratios of the images.
+	if fit {
+		fitLayout(items)
+	}
+
+	// Only the grid layout has rows of a fixed length.
+	if completeRows && layout == LayoutGrid {
+		if featured > 0 {
+			items = trimToCompleteFeaturedGrid(items)
+		} else {
+			items = trimToCompleteRows(items)
+		}
+	}
 
 	// Create the wallpaper image composed from all downloaded images
-	buildWallpaper(items)
+	buildWallpaper(ctx, items)
+	markCacheUsed(items)
+
+	// Apply the cache policies, but never remove the current images.
+	protected := make(map[string]bool, len(items))
+	for _, item := range items {
+		protected[item.cachePath()] = true
+	}
+
+	if err := pruneCache(protected); err != nil {
+		log.Printf("Error: Failed to prune cache, %s", err.Error())
+	}
 }
@@ -0,0 +1,259 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const MastodonPageSize = 40
+
+var linkHeaderPart = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="?([^";]+)"?`)
+
+type MastodonAPI struct {
+	Key     string
+	BaseURL string
+}
+
+func (ma *MastodonAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	q := url.Values{}
+	q.Set("only_media", "true")
+	q.Set("limit", strconv.Itoa(MastodonPageSize))
+
+	var endPoint string
+
+	if strings.HasPrefix(options.Profile, "tag:") {
+		hashtag := strings.TrimPrefix(strings.TrimPrefix(options.Profile, "tag:"), "#")
+		endPoint = "/api/v1/timelines/tag/" + url.PathEscape(hashtag)
+
+		if len(options.Tag) > 0 {
+			q.Set("all[]", options.Tag)
+		}
+	} else {
+		accountID, err := ma.lookupAccount(ctx, strings.TrimPrefix(options.Profile, "account:"))
+		if err != nil {
+			return nil, err
+		}
+
+		endPoint = "/api/v1/accounts/" + url.PathEscape(accountID) + "/statuses"
+		q.Set("exclude_replies", "true")
+
+		if len(options.Tag) > 0 {
+			q.Set("tagged", options.Tag)
+		}
+	}
+
+	limit := options.Limit
+	items := make([]*MediaItem, 0, limit)
+	pageURL := ma.BaseURL + endPoint + "?" + q.Encode()
+
+	for limit > 0 && len(pageURL) > 0 {
+		pageItems, next, err := ma.fetchItemsForPage(ctx, pageURL, options.Size, options.Sensitive)
+		if err != nil {
+			return nil, err
+		}
+
+		// Remove any items over limit
+		if len(pageItems) > limit {
+			pageItems = pageItems[:limit]
+		}
+
+		items = append(items, pageItems...)
+		limit -= len(pageItems)
+		pageURL = next
+	}
+
+	return items, nil
+}
+
+func (ma *MastodonAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+func (ma *MastodonAPI) lookupAccount(ctx context.Context, acct string) (string, error) {
+	q := url.Values{}
+	q.Set("acct", strings.TrimPrefix(acct, "@"))
+
+	resp, err := ma.get(ctx, ma.BaseURL+"/api/v1/accounts/lookup?"+q.Encode())
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	var account struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		return "", err
+	}
+
+	return account.ID, nil
+}
+
+func (ma *MastodonAPI) fetchItemsForPage(ctx context.Context, endPoint string, size int, sensitive bool) ([]*MediaItem, string, error) {
+	resp, err := ma.get(ctx, endPoint)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	var statuses []*mastodonStatus
+
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil, "", err
+	}
+
+	mediaItems := make([]*MediaItem, 0, len(statuses))
+
+	for _, status := range statuses {
+		// Boosts carry the original status.
+		if status.Reblog != nil {
+			status = status.Reblog
+		}
+
+		if status.Sensitive && !sensitive {
+			continue
+		}
+
+		for _, media := range status.MediaAttachments {
+			if media.Type != "image" || media.Meta == nil || media.Meta.Original == nil {
+				continue
+			}
+
+			item := &MediaItem{
+				ID:     media.ID,
+				URL:    media.URL,
+				Width:  media.Meta.Original.Width,
+				Height: media.Meta.Original.Height,
+				Score:  status.FavouritesCount + status.ReblogsCount,
+			}
+
+			// Use the preview if it is large enough.
+			if small := media.Meta.Small; small != nil && small.Width >= size && small.Height >= size && len(media.PreviewURL) > 0 {
+				item.URL = media.PreviewURL
+				item.Width = small.Width
+				item.Height = small.Height
+			}
+
+			if status.Account != nil {
+				item.Author = status.Account.DisplayName
+				item.AuthorURL = status.Account.URL
+			}
+
+			mediaItems = append(mediaItems, item)
+		}
+	}
+
+	next := findLink(resp.Header, "next")
+
+	// An empty page means there are no more statuses.
+	if len(statuses) == 0 {
+		next = ""
+	}
+
+	return mediaItems, next, nil
+}
+
+func (ma *MastodonAPI) get(ctx context.Context, endPoint string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", endPoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Some instances require authentication for public timelines.
+	if len(ma.Key) > 0 {
+		req.Header.Set("Authorization", "Bearer "+ma.Key)
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		var errInfo struct {
+			Error string `json:"error"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&errInfo); err != nil || len(errInfo.Error) == 0 {
+			return nil, fmt.Errorf("%q responded with %q", endPoint, resp.Status)
+		}
+
+		return nil, errors.New(errInfo.Error)
+	}
+
+	return resp, nil
+}
+
+type mastodonStatus struct {
+	Sensitive       bool `json:"sensitive"`
+	FavouritesCount int  `json:"favourites_count"`
+	ReblogsCount    int  `json:"reblogs_count"`
+	Account         *struct {
+		DisplayName string `json:"display_name"`
+		URL         string `json:"url"`
+	} `json:"account"`
+	MediaAttachments []*struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		URL        string `json:"url"`
+		PreviewURL string `json:"preview_url"`
+		Meta       *struct {
+			Original *mastodonMediaSize `json:"original"`
+			Small    *mastodonMediaSize `json:"small"`
+		} `json:"meta"`
+	} `json:"media_attachments"`
+	Reblog *mastodonStatus `json:"reblog"`
+}
+
+type mastodonMediaSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// findLink returns the URL of the given relation from the Link header.
+func findLink(header http.Header, rel string) string {
+	for _, value := range header["Link"] {
+		for _, match := range linkHeaderPart.FindAllStringSubmatch(value, -1) {
+			for _, r := range strings.Fields(match[2]) {
+				if r == rel {
+					return match[1]
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// mastodonBaseURL turns an instance name into its base URL.
+func mastodonBaseURL(instance string) string {
+	if !strings.Contains(instance, "://") {
+		instance = "https://" + instance
+	}
+
+	return strings.TrimSuffix(instance, "/")
+}
+
+func NewMastodonAPI(key string) API {
+	return &MastodonAPI{key, mastodonBaseURL(instance)}
+}
+
+func init() {
+	apiFactory.Register("mastodon", NewMastodonAPI)
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Two pages of statuses, linked by the Link header.
+var mastodonTestPages = []string{`[
+	{"account": {"display_name": "Alice", "url": "https://example.com/@alice"}, "favourites_count": 3, "media_attachments": [
+		{"id": "1", "type": "image", "url": "/1.jpg", "meta": {"original": {"width": 1200, "height": 800}}},
+		{"id": "2", "type": "video", "url": "/2.mp4", "meta": {"original": {"width": 1920, "height": 1080}}},
+		{"id": "3", "type": "image", "url": "/3.jpg"}
+	]},
+	{"sensitive": true, "media_attachments": [
+		{"id": "4", "type": "image", "url": "/4.jpg", "meta": {"original": {"width": 640, "height": 480}}}
+	]}
+]`, `[
+	{"reblog": {"media_attachments": [
+		{"id": "5", "type": "image", "url": "/5.jpg", "preview_url": "/5-small.jpg",
+		 "meta": {"original": {"width": 3000, "height": 2000}, "small": {"width": 600, "height": 400}}}
+	]}},
+	{"media_attachments": [
+		{"id": "6", "type": "gifv", "url": "/6.mp4", "meta": {"original": {"width": 320, "height": 240}}}
+	]}
+]`}
+
+func newMastodonTestServer(requests *[]string) *httptest.Server {
+	var server *httptest.Server
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.URL.EscapedPath())
+
+		switch {
+		case r.URL.Path == "/api/v1/accounts/lookup":
+			fmt.Fprintf(w, `{"id": "%s 1"}`, r.URL.Query().Get("acct"))
+		case strings.HasSuffix(r.URL.Path, "/statuses") || strings.HasPrefix(r.URL.Path, "/api/v1/timelines/tag/"):
+			if r.URL.Query().Get("page") == "2" {
+				fmt.Fprint(w, mastodonTestPages[1])
+				return
+			}
+
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next", <%s/prev>; rel="prev"`, server.URL, r.URL.EscapedPath(), server.URL))
+			fmt.Fprint(w, mastodonTestPages[0])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	return server
+}
+
+func TestMastodonAPI(t *testing.T) {
+	tests := []struct {
+		name      string
+		profile   string
+		sensitive bool
+		size      int
+		limit     int
+		ids       []string
+		path      string
+	}{
+		{"account", "account:@alice", false, 100, 10, []string{"1", "5"}, "/api/v1/accounts/alice%201/statuses"},
+		{"hashtag", "tag:#sunny days", false, 100, 10, []string{"1", "5"}, "/api/v1/timelines/tag/sunny%20days"},
+		{"sensitive", "tag:sunset", true, 100, 10, []string{"1", "4", "5"}, "/api/v1/timelines/tag/sunset"},
+		{"limit", "tag:sunset", false, 100, 1, []string{"1"}, "/api/v1/timelines/tag/sunset"},
+		{"original size", "tag:sunset", false, 1000, 10, []string{"1", "5"}, "/api/v1/timelines/tag/sunset"},
+	}
+
+	for _, test := range tests {
+		var requests []string
+
+		server := newMastodonTestServer(&requests)
+		api := &MastodonAPI{BaseURL: server.URL}
+
+		items, err := api.FetchMediaItems(context.Background(), APIFetchOptions{
+			Profile:   test.profile,
+			Size:      test.size,
+			Limit:     test.limit,
+			Sensitive: test.sensitive,
+		})
+		server.Close()
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		var ids []string
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+
+		if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+			t.Errorf("%s: items %v, want %v", test.name, ids, test.ids)
+		}
+
+		// Profiles are escaped as path segments.
+		if requests[len(requests)-1] != test.path {
+			t.Errorf("%s: requested %q, want %q", test.name, requests[len(requests)-1], test.path)
+		}
+
+		for _, item := range items {
+			var want string
+
+			switch {
+			case item.ID == "1":
+				want = "/1.jpg 1200x800 Alice"
+			case item.ID == "5" && test.size <= 400:
+				want = "/5-small.jpg 600x400 "
+			case item.ID == "5":
+				want = "/5.jpg 3000x2000 "
+			default:
+				continue
+			}
+
+			got := fmt.Sprintf("%s %dx%d %s", strings.TrimPrefix(item.URL, server.URL), item.Width, item.Height, item.Author)
+			if got != want {
+				t.Errorf("%s: item %s is %q, want %q", test.name, item.ID, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math/rand"
+	"os"
+)
+
+// mosaicTile is a downloaded image prepared for the mosaic, scaled and
+// cropped to the cell size.
+type mosaicTile struct {
+	img  *image.RGBA
+	avg  color.RGBA
+	uses int
+}
+
+func parseMosaicOptions() {
+	if len(mosaicTarget) == 0 {
+		fatalIf(fmt.Errorf("The mosaic layout requires a -target image"))
+	}
+
+	if cellSize < 1 {
+		fatalIf(fmt.Errorf("-cell must be at least 1"))
+	}
+
+	if mosaicReuse < 0 {
+		fatalIf(fmt.Errorf("-reuse must not be negative"))
+	}
+
+	if tint < 0 || tint > 100 {
+		fatalIf(fmt.Errorf("-tint must be between 0 and 100"))
+	}
+
+	if fit || featured > 0 {
+		fatalIf(fmt.Errorf("-fit and -featured don't apply to the mosaic layout"))
+	}
+
+	// Load the target early to fail before fetching anything.
+	file, err := os.Open(mosaicTarget)
+	fatalIf(err)
+
+	defer file.Close()
+
+	targetImage, _, err = image.Decode(file)
+	if err != nil {
+		fatalIf(fmt.Errorf("Failed to read target %q, %s", mosaicTarget, err.Error()))
+	}
+}
+
+// averageColor returns the mean color of all pixels of the image.
+func averageColor(img *image.RGBA) color.RGBA {
+	var r, g, b, n int
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			r += int(c.R)
+			g += int(c.G)
+			b += int(c.B)
+			n++
+		}
+	}
+
+	if n == 0 {
+		return color.RGBA{A: 255}
+	}
+
+	return color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 255}
+}
+
+func colorDistance(a, b color.RGBA) int {
+	dr := int(a.R) - int(b.R)
+	dg := int(a.G) - int(b.G)
+	db := int(a.B) - int(b.B)
+
+	return dr*dr + dg*dg + db*db
+}
+
+// prepareMosaicTiles scales the cached images to the cell size and
+// computes their average colors. Placeholders are left out.
+func prepareMosaicTiles(ctx context.Context, items []*MediaItem) []*mosaicTile {
+	tiles := make([]*mosaicTile, 0, len(items))
+
+	for _, item := range items {
+		exitIfCanceled(ctx)
+
+		if item.Placeholder {
+			continue
+		}
+
+		img, err := openTileImage(item)
+		if err != nil {
+			fatalIf(fmt.Errorf("%s with image %s", err.Error(), item.ID))
+		}
+
+		rgba := coverImage(img, cellSize, cellSize)
+		tiles = append(tiles, &mosaicTile{img: rgba, avg: averageColor(rgba)})
+	}
+
+	return tiles
+}
+
+// mosaicCellColors scales the target to cover the grid of cells, so
+// that each pixel is the average color of one cell.
+func mosaicCellColors(cols, rows int) []color.RGBA {
+	target := coverImage(targetImage, cols, rows)
+	colors := make([]color.RGBA, 0, cols*rows)
+
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			colors = append(colors, target.RGBAAt(x, y))
+		}
+	}
+
+	return colors
+}
+
+// tintTile shifts the colors of the tile by -tint percent of the
+// difference between its average color and the cell color. Unlike
+// blending, this keeps the contrast of the image.
+func tintTile(tile *mosaicTile, cell color.RGBA) *image.RGBA {
+	shift := func(v, from, to uint8) uint8 {
+		return uint8(minInt(maxInt(int(v)+(int(to)-int(from))*tint/100, 0), 255))
+	}
+
+	tinted := image.NewRGBA(tile.img.Bounds())
+
+	for i := 0; i < len(tile.img.Pix); i += 4 {
+		tinted.Pix[i] = shift(tile.img.Pix[i], tile.avg.R, cell.R)
+		tinted.Pix[i+1] = shift(tile.img.Pix[i+1], tile.avg.G, cell.G)
+		tinted.Pix[i+2] = shift(tile.img.Pix[i+2], tile.avg.B, cell.B)
+		tinted.Pix[i+3] = 255
+	}
+
+	return tinted
+}
+
+// drawMosaic reproduces the -target image with the items. The canvas is
+// divided into cells of -cell pixels and each cell gets the image whose
+// average color is closest to the cell's color. An image is used at most
+// -reuse times, so that the mosaic shows all of them.
+func drawMosaic(ctx context.Context, wp *image.RGBA, items []*MediaItem) {
+	tiles := prepareMosaicTiles(ctx, items)
+	if len(tiles) == 0 {
+		fatalIf(fmt.Errorf("No images for the mosaic"))
+	}
+
+	cols := ceilIntDivision(outputWidth, cellSize)
+	rows := ceilIntDivision(outputHeight, cellSize)
+	cells := mosaicCellColors(cols, rows)
+
+	// Every cell needs an image.
+	reuse := ceilIntDivision(len(cells), len(tiles))
+
+	if mosaicReuse > 0 && mosaicReuse < reuse {
+		log.Printf("Warning: %d images are too few for %d cells, using each image up to %d times", len(tiles), len(cells), reuse)
+	} else if mosaicReuse > 0 {
+		reuse = mosaicReuse
+	}
+
+	log.Printf("Composing mosaic of %d cells from %d images", len(cells), len(tiles))
+
+	// Cells assigned first get the best matches. Assigning them in a
+	// scattered order avoids that the images run out towards the bottom
+	// of the canvas. The fixed seed makes the mosaic reproducible.
+	order := rand.New(rand.NewSource(1)).Perm(len(cells))
+
+	for _, i := range order {
+		exitIfCanceled(ctx)
+
+		var best *mosaicTile
+		bestDistance := 0
+
+		for _, tile := range tiles {
+			if tile.uses >= reuse {
+				continue
+			}
+
+			if d := colorDistance(tile.avg, cells[i]); best == nil || d < bestDistance {
+				best, bestDistance = tile, d
+			}
+		}
+
+		best.uses++
+
+		img := best.img
+		if tint > 0 {
+			img = tintTile(best, cells[i])
+		}
+
+		dp := image.Pt(i%cols*cellSize, i/cols*cellSize)
+		draw.Draw(wp, image.Rectangle{dp, dp.Add(img.Bounds().Size())}, img, image.ZP, draw.Src)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	PexelsPageSize = 80
+
+	// Pexels has no user endpoint, so user profiles are filtered from
+	// curated or search results. This limits the number of pages searched.
+	PexelsMaxUserPages = 25
+)
+
+type PexelsAPI struct {
+	Key     string
+	BaseURL string
+}
+
+func (pa *PexelsAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	profileParts := strings.SplitN(options.Profile, ":", 2)
+	feature := profileParts[0]
+
+	if feature != "search" && feature != "curated" && len(profileParts) != 2 {
+		return nil, fmt.Errorf("Missing value in profile - %s:<value>", feature)
+	}
+
+	var endPoint, photographer string
+	q := url.Values{}
+
+	switch feature {
+	case "collection":
+		endPoint = fmt.Sprintf("/collections/%s", url.PathEscape(profileParts[1]))
+		q.Set("type", "photos")
+	case "search":
+		if len(options.Tag) == 0 {
+			return nil, fmt.Errorf("Pexels search requires a tag")
+		}
+
+		endPoint = "/search"
+	case "curated":
+		endPoint = "/curated"
+	case "user":
+		endPoint = "/curated"
+		photographer = strings.TrimPrefix(profileParts[1], "@")
+	default:
+		return nil, fmt.Errorf("Unknown Pexels profile %q - use user, collection, search or curated", feature)
+	}
+
+	if len(options.Tag) > 0 {
+		if feature == "collection" || feature == "curated" {
+			return nil, fmt.Errorf("Pexels supports the tag filter only for search and user profiles")
+		}
+
+		endPoint = "/search"
+		q.Set("query", options.Tag)
+	}
+
+	q.Set("per_page", strconv.Itoa(PexelsPageSize))
+
+	limit := options.Limit
+	items := make([]*MediaItem, 0, limit)
+	pageURL := pa.BaseURL + endPoint + "?" + q.Encode()
+
+	for page := 1; limit > 0 && len(pageURL) > 0; page++ {
+		if len(photographer) > 0 && page > PexelsMaxUserPages {
+			break
+		}
+
+		pageItems, next, err := pa.fetchItemsForPage(ctx, pageURL, options.Size, options.Square, photographer)
+		if err != nil {
+			return nil, err
+		}
+
+		// Remove any items over limit
+		if len(pageItems) > limit {
+			pageItems = pageItems[:limit]
+		}
+
+		items = append(items, pageItems...)
+		limit -= len(pageItems)
+		pageURL = next
+	}
+
+	return items, nil
+}
+
+func (pa *PexelsAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+func (pa *PexelsAPI) fetchItemsForPage(ctx context.Context, endPoint string, size int, square bool, photographer string) ([]*MediaItem, string, error) {
+	req, err := http.NewRequest("GET", endPoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Authorization", pa.Key)
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errInfo struct {
+			Error string `json:"error"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&errInfo); err != nil || len(errInfo.Error) == 0 {
+			return nil, "", fmt.Errorf("Pexels responded with %q", resp.Status)
+		}
+
+		return nil, "", errors.New(errInfo.Error)
+	}
+
+	var media struct {
+		// Collections return "media", anything else "photos"
+		Photos   []*pexelsPhoto `json:"photos"`
+		Media    []*pexelsPhoto `json:"media"`
+		NextPage string         `json:"next_page"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&media); err != nil {
+		return nil, "", err
+	}
+
+	photos := append(media.Photos, media.Media...)
+	mediaItems := make([]*MediaItem, 0, len(photos))
+
+	for _, photo := range photos {
+		// Collections may contain videos.
+		if (len(photo.Type) > 0 && photo.Type != "Photo") || photo.Src == nil {
+			continue
+		}
+
+		if photo.Width == 0 || photo.Height == 0 {
+			continue
+		}
+
+		if len(photographer) > 0 && !strings.HasSuffix(strings.TrimSuffix(photo.PhotographerURL, "/"), "/@"+photographer) {
+			continue
+		}
+
+		item := &MediaItem{
+			ID:        strconv.Itoa(photo.ID),
+			Author:    photo.Photographer,
+			AuthorURL: photo.PhotographerURL,
+		}
+
+		// Let Pexels resize and crop the image to the size we need.
+		params := url.Values{}
+		params.Set("auto", "compress")
+		params.Set("cs", "tinysrgb")
+
+		if square {
+			item.Width, item.Height = size, size
+			params.Set("fit", "crop")
+			params.Set("w", strconv.Itoa(size))
+			params.Set("h", strconv.Itoa(size))
+		} else {
+			item.Width, item.Height = scaleToLongEdge(photo.Width, photo.Height, size)
+			params.Set(longEdgeParam(photo.Width, photo.Height), strconv.Itoa(size))
+		}
+
+		item.URL, err = resizedImageURL(photo.Src.Original, params)
+		if err != nil {
+			continue
+		}
+
+		mediaItems = append(mediaItems, item)
+	}
+
+	return mediaItems, media.NextPage, nil
+}
+
+type pexelsPhoto struct {
+	ID              int    `json:"id"`
+	Type            string `json:"type"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	Photographer    string `json:"photographer"`
+	PhotographerURL string `json:"photographer_url"`
+	Src             *struct {
+		Original string `json:"original"`
+	} `json:"src"`
+}
+
+func NewPexelsAPI(key string) API {
+	return &PexelsAPI{key, "https://api.pexels.com/v1"}
+}
+
+func init() {
+	apiFactory.Register("pexels", NewPexelsAPI)
+}
@@ -0,0 +1,430 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cacheEntry is a cached image together with its metadata file.
+type cacheEntry struct {
+	Namespace string
+	ID        string
+	Paths     []string
+	Size      int64
+	LastUsed  time.Time
+}
+
+type cacheEntriesByLastUse []*cacheEntry
+
+func (c cacheEntriesByLastUse) Len() int           { return len(c) }
+func (c cacheEntriesByLastUse) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c cacheEntriesByLastUse) Less(i, j int) bool { return c[i].LastUsed.Before(c[j].LastUsed) }
+
+type filesByModTime []os.FileInfo
+
+func (f filesByModTime) Len() int           { return len(f) }
+func (f filesByModTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f filesByModTime) Less(i, j int) bool { return f[i].ModTime().After(f[j].ModTime()) }
+
+func isWallpaperFile(name string) bool {
+	return strings.HasPrefix(name, "wallpaper_") && strings.HasSuffix(name, ".jpg")
+}
+
+// scanCache returns all cached images grouped by namespace as well as
+// the wallpapers. Images of the old cache layout, stored directly in the
+// cache directory, are returned with an empty namespace.
+func scanCache() (map[string][]*cacheEntry, []os.FileInfo, error) {
+	files, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	namespaces := make(map[string][]*cacheEntry)
+	var wallpapers []os.FileInfo
+	var legacy []os.FileInfo
+
+	for _, file := range files {
+		switch {
+		case file.IsDir():
+			entries, err := scanNamespace(file.Name())
+			if err != nil {
+				return nil, nil, err
+			}
+
+			namespaces[file.Name()] = entries
+		case isWallpaperFile(file.Name()):
+			wallpapers = append(wallpapers, file)
+		case isTempFile(file.Name()):
+			// Written by a running photowall process
+		default:
+			legacy = append(legacy, file)
+		}
+	}
+
+	for _, file := range legacy {
+		namespaces[""] = append(namespaces[""], &cacheEntry{
+			ID:       file.Name(),
+			Paths:    []string{filepath.Join(cacheDir, file.Name())},
+			Size:     file.Size(),
+			LastUsed: file.ModTime(),
+		})
+	}
+
+	sort.Sort(filesByModTime(wallpapers))
+
+	return namespaces, wallpapers, nil
+}
+
+func scanNamespace(namespace string) ([]*cacheEntry, error) {
+	dir := filepath.Join(cacheDir, namespace)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*cacheEntry)
+	var ids []string
+
+	for _, file := range files {
+		if file.IsDir() || isTempFile(file.Name()) {
+			continue
+		}
+
+		id := cacheID(file.Name())
+		entry := entries[id]
+
+		if entry == nil {
+			entry = &cacheEntry{Namespace: namespace, ID: id}
+			entries[id] = entry
+			ids = append(ids, id)
+		}
+
+		entry.Paths = append(entry.Paths, filepath.Join(dir, file.Name()))
+		entry.Size += file.Size()
+
+		if file.ModTime().After(entry.LastUsed) {
+			entry.LastUsed = file.ModTime()
+		}
+	}
+
+	result := make([]*cacheEntry, 0, len(ids))
+
+	for _, id := range ids {
+		entry := entries[id]
+
+		// Prefer the recorded last use over the file times.
+		item := &MediaItem{ID: id, Source: &Source{CacheDir: dir}}
+		if meta, err := loadCacheMeta(item); err == nil {
+			if !meta.LastUsed.IsZero() {
+				entry.LastUsed = meta.LastUsed
+			} else if !meta.Fetched.IsZero() {
+				entry.LastUsed = meta.Fetched
+			}
+		}
+
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+func removeCacheEntry(entry *cacheEntry) bool {
+	removed := true
+
+	for _, path := range entry.Paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error: Failed to remove %q, %s", path, err.Error())
+			removed = false
+		}
+	}
+
+	return removed
+}
+
+// parseCacheOptions validates the cache policies before anything
+// is downloaded.
+func parseCacheOptions() {
+	var err error
+
+	cacheMaxBytes, err = parseByteSize(cacheMaxSize)
+	fatalIf(err)
+
+	if cacheMaxAge < 0 {
+		fatalIf(fmt.Errorf("-cache-max-age must not be negative"))
+	}
+
+	if keepWallpapers < 0 {
+		fatalIf(fmt.Errorf("-keep-wallpapers must not be negative"))
+	}
+}
+
+// pruneCache applies the cache policies. Images in protected, identified
+// by their cache path, are never removed.
+func pruneCache(protected map[string]bool) error {
+	namespaces, wallpapers, err := scanCache()
+	if err != nil {
+		return err
+	}
+
+	var removedFiles int
+	var freedBytes int64
+
+	remove := func(entry *cacheEntry, reason string) {
+		log.Printf("Removing %s image %q", reason, filepath.Join(entry.Namespace, entry.ID))
+
+		if removeCacheEntry(entry) {
+			removedFiles++
+			freedBytes += entry.Size
+		}
+	}
+
+	var entries []*cacheEntry
+	var totalBytes int64
+	now := time.Now()
+
+	for namespace, nsEntries := range namespaces {
+		for _, entry := range nsEntries {
+			isProtected := protected[filepath.Join(cacheDir, namespace, entry.ID)]
+
+			switch {
+			case isProtected:
+			case len(namespace) == 0:
+				// Images of the old cache layout aren't used anymore.
+				remove(entry, "outdated")
+				continue
+			case cacheMaxAge > 0 && now.Sub(entry.LastUsed) > cacheMaxAge:
+				remove(entry, "expired")
+				continue
+			}
+
+			totalBytes += entry.Size
+
+			if !isProtected {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	// Evict the least recently used images until the cache fits.
+	if cacheMaxBytes > 0 && totalBytes > cacheMaxBytes {
+		sort.Sort(cacheEntriesByLastUse(entries))
+
+		for _, entry := range entries {
+			if totalBytes <= cacheMaxBytes {
+				break
+			}
+
+			remove(entry, "least recently used")
+			totalBytes -= entry.Size
+		}
+
+		if totalBytes > cacheMaxBytes {
+			log.Printf("Warning: cache exceeds %s, the current images alone need %s", formatByteSize(cacheMaxBytes), formatByteSize(totalBytes))
+		}
+	}
+
+	// Keep the newest wallpapers only
+	if keepWallpapers > 0 {
+		for _, wallpaper := range wallpapers[minInt(keepWallpapers, len(wallpapers)):] {
+			path := filepath.Join(cacheDir, wallpaper.Name())
+			log.Printf("Removing old wallpaper %q", path)
+
+			if err := os.Remove(path); err != nil {
+				log.Printf("Error: Failed to remove %q, %s", path, err.Error())
+				continue
+			}
+
+			removedFiles++
+			freedBytes += wallpaper.Size()
+		}
+	}
+
+	// Remove empty namespaces, non-empty directories are left untouched.
+	for namespace := range namespaces {
+		if len(namespace) > 0 {
+			os.Remove(filepath.Join(cacheDir, namespace))
+		}
+	}
+
+	if removedFiles > 0 {
+		log.Printf("Pruned %d cache entries, freed %s", removedFiles, formatByteSize(freedBytes))
+	}
+
+	return nil
+}
+
+// markCacheUsed records the last use of the items' cached images, which
+// is used for the least recently used eviction.
+func markCacheUsed(items []*MediaItem) {
+	now := time.Now()
+
+	for _, item := range items {
+		if item.Placeholder {
+			continue
+		}
+
+		meta, err := loadCacheMeta(item)
+		if err != nil {
+			continue
+		}
+
+		meta.LastUsed = now
+
+		if err := saveCacheMeta(item, meta); err != nil {
+			log.Printf("Error: Failed to save metadata of %q, %s", item.ID, err.Error())
+		}
+	}
+}
+
+func printCacheStats() error {
+	namespaces, wallpapers, err := scanCache()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		names = append(names, namespace)
+	}
+
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tIMAGES\tSIZE\tLAST USED")
+
+	var totalImages int
+	var totalBytes int64
+
+	for _, namespace := range names {
+		var size int64
+		var lastUsed time.Time
+
+		for _, entry := range namespaces[namespace] {
+			size += entry.Size
+
+			if entry.LastUsed.After(lastUsed) {
+				lastUsed = entry.LastUsed
+			}
+		}
+
+		name := namespace
+		if len(name) == 0 {
+			name = "(outdated layout)"
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", name, len(namespaces[namespace]), formatByteSize(size), lastUsed.Format("2006-01-02 15:04"))
+
+		totalImages += len(namespaces[namespace])
+		totalBytes += size
+	}
+
+	var wallpaperBytes int64
+	for _, wallpaper := range wallpapers {
+		wallpaperBytes += wallpaper.Size()
+	}
+
+	fmt.Fprintf(w, "wallpapers\t%d\t%s\t\n", len(wallpapers), formatByteSize(wallpaperBytes))
+	fmt.Fprintf(w, "total\t%d\t%s\t\n", totalImages+len(wallpapers), formatByteSize(totalBytes+wallpaperBytes))
+
+	return w.Flush()
+}
+
+// runCacheCommand executes the cache sub commands stats and prune.
+// Options may follow the command.
+func runCacheCommand(args []string) {
+	if len(args) < 2 || args[0] != "cache" {
+		flag.Usage()
+		fatalIf(fmt.Errorf("Unknown command %q", strings.Join(args, " ")))
+	}
+
+	command := args[1]
+	fatalIf(flag.CommandLine.Parse(args[2:]))
+	parseCacheOptions()
+
+	fallbackDirOption()
+	cacheDir = filepath.Join(baseDir, CacheDirName)
+
+	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
+		fatalIf(fmt.Errorf("No cache found in %q", baseDir))
+	}
+
+	fatalIf(acquireLock(baseDir))
+	defer releaseLock()
+
+	switch command {
+	case "stats":
+		fatalIf(printCacheStats())
+	case "prune":
+		fatalIf(pruneCache(nil))
+	default:
+		flag.Usage()
+		fatalIf(fmt.Errorf("Unknown cache command %q - use stats or prune", command))
+	}
+}
+
+var byteSizeUnits = []string{"B", "KB", "MB", "GB", "TB"}
+
+// parseByteSize parses sizes like 500MB or 2G. Units are powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	num := strings.TrimRight(s, "KMGTB")
+	unit := strings.TrimSuffix(s[len(num):], "B")
+
+	size, err := strconv.ParseFloat(num, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+
+	for _, u := range byteSizeUnits[1:] {
+		if len(unit) == 0 {
+			break
+		}
+
+		size *= 1024
+
+		if u[:1] == unit {
+			unit = ""
+			break
+		}
+	}
+
+	if len(unit) > 0 {
+		return 0, fmt.Errorf("Invalid size unit %q", s)
+	}
+
+	return int64(size), nil
+}
+
+func formatByteSize(size int64) string {
+	value := float64(size)
+	unit := 0
+
+	for value >= 1024 && unit < len(byteSizeUnits)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, byteSizeUnits[unit])
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"1K", 1024, true},
+		{"1KB", 1024, true},
+		{"1.5kb", 1536, true},
+		{"500MB", 500 << 20, true},
+		{" 2G ", 2 << 30, true},
+		{"1TB", 1 << 40, true},
+		{"MB", 0, false},
+		{"-1MB", 0, false},
+		{"5XB", 0, false},
+		{"5BB", 0, false},
+		{"5MK", 0, false},
+		{"5PB", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseByteSize(test.s)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d, ok %t", test.s, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestFormatByteSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{500 << 20, "500.0 MB"},
+		{3 << 40, "3.0 TB"},
+		{2048 << 40, "2048.0 TB"},
+	}
+
+	for _, test := range tests {
+		if got := formatByteSize(test.size); got != test.want {
+			t.Errorf("formatByteSize(%d) = %q, want %q", test.size, got, test.want)
+		}
+	}
+}
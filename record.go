@@ -0,0 +1,212 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Suffixes of the files of a recorded exchange
+	RecordMetaSuffix = ".json"
+	RecordBodySuffix = ".body"
+
+	// Replaces credentials in the path of recorded URLs
+	RecordRedacted = "REDACTED"
+)
+
+// recordedResponse is the metadata of a recorded exchange. The body is
+// stored next to it.
+type recordedResponse struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+}
+
+// recordingEnabled reports whether HTTP exchanges are recorded or
+// replayed. Conditional requests are disabled then, so that every
+// response carries the full body.
+func recordingEnabled() bool {
+	return len(recordDir) > 0 || len(replayDir) > 0
+}
+
+// credentials returns the API keys passed with -key. The JSON API
+// gets its {key} placeholder from there as well.
+func credentials() []string {
+	var keys []string
+
+	for _, key := range apiKeys() {
+		if len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// redactedURL returns the URL without credentials, so that recordings can
+// be shared and replayed without keys. Query parameters holding a key are
+// removed, as are empty ones, which a run without keys passes instead.
+// Keys in the path are replaced.
+func redactedURL(u *url.URL) string {
+	redacted := *u
+	q := redacted.Query()
+	keys := credentials()
+
+	hasKey := func(s string) bool {
+		for _, key := range keys {
+			if strings.Contains(s, key) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for name, values := range q {
+		for _, value := range values {
+			if len(value) == 0 || hasKey(value) {
+				q.Del(name)
+				break
+			}
+		}
+	}
+
+	for _, key := range keys {
+		redacted.Path = strings.Replace(redacted.Path, key, RecordRedacted, -1)
+		redacted.RawPath = strings.Replace(redacted.RawPath, url.PathEscape(key), RecordRedacted, -1)
+	}
+
+	redacted.RawQuery = q.Encode()
+	return redacted.String()
+}
+
+// recordPath returns the path of a recorded exchange, without suffix.
+func recordPath(dir string, req *http.Request) string {
+	sum := sha1.Sum([]byte(req.Method + " " + redactedURL(req.URL)))
+	return filepath.Join(dir, fmt.Sprintf("%x", sum))
+}
+
+// recordTransport saves every exchange to a directory.
+type recordTransport struct {
+	Transport http.RoundTripper
+	Dir       string
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	header := resp.Header
+	if len(header.Get("Set-Cookie")) > 0 {
+		header = cloneHeader(header)
+		header.Del("Set-Cookie")
+	}
+
+	record := &recordedResponse{
+		Method: req.Method,
+		URL:    redactedURL(req.URL),
+		Status: resp.StatusCode,
+		Header: header,
+	}
+
+	path := recordPath(t.Dir, req)
+
+	err = writeFileAtomic(path+RecordBodySuffix, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFileAtomic(path+RecordMetaSuffix, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(record)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// replayTransport serves recorded exchanges without any network access.
+type replayTransport struct {
+	Dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := recordPath(t.Dir, req)
+
+	file, err := os.Open(path + RecordMetaSuffix)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No recorded response for %s %s", req.Method, redactedURL(req.URL))
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var record recordedResponse
+	if err := json.NewDecoder(file).Decode(&record); err != nil {
+		return nil, fmt.Errorf("Invalid recording %q, %s", file.Name(), err.Error())
+	}
+
+	data, err := ioutil.ReadFile(path + RecordBodySuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Header == nil {
+		record.Header = make(http.Header)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", record.Status, http.StatusText(record.Status)),
+		StatusCode:    record.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        record.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+
+	return clone
+}
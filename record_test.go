@@ -0,0 +1,46 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedactedURL(t *testing.T) {
+	oldKey := apiKey
+	defer func() { apiKey = oldKey }()
+
+	tests := []struct {
+		key  string
+		url  string
+		want string
+	}{
+		{"secret", "https://api.example.com/photos?api_key=secret&page=2", "https://api.example.com/photos?page=2"},
+		{"secret", "https://api.example.com/photos?auth=Bearer+secret&user=jondoe", "https://api.example.com/photos?user=jondoe"},
+		{"secret", "https://api.example.com/v1/secret/photos?page=1", "https://api.example.com/v1/REDACTED/photos?page=1"},
+
+		// Parameters are kept by name, only their values matter.
+		{"secret", "https://api.example.com/photos?key=jondoe", "https://api.example.com/photos?key=jondoe"},
+
+		// Runs without keys pass empty parameters instead.
+		{"", "https://api.example.com/photos?api_key=&page=2", "https://api.example.com/photos?page=2"},
+
+		{"flickr=abc,json=xyz", "https://example.com/xyz/photos?api_key=abc", "https://example.com/REDACTED/photos"},
+	}
+
+	for _, test := range tests {
+		apiKey = test.key
+
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := redactedURL(u); got != test.want {
+			t.Errorf("redactedURL(%q) with -key %q = %q, want %q", test.url, test.key, got, test.want)
+		}
+	}
+}
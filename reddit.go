@@ -0,0 +1,279 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const RedditPageSize = 100
+
+type RedditAPI struct {
+	BaseURL string
+}
+
+func (ra *RedditAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	// Profile format: <subreddit>[:<sort>[:<time>]]
+	profileParts := strings.SplitN(options.Profile, ":", 3)
+	subreddit := strings.TrimPrefix(strings.TrimPrefix(profileParts[0], "/"), "r/")
+	sort := "hot"
+
+	if len(profileParts) > 1 {
+		sort = profileParts[1]
+	}
+
+	switch sort {
+	case "hot", "new", "top", "rising", "controversial":
+	default:
+		return nil, fmt.Errorf("Unknown reddit sort %q - use hot, new, top, rising or controversial", sort)
+	}
+
+	profileURL, err := url.Parse(fmt.Sprintf(ra.BaseURL, url.QueryEscape(subreddit), sort))
+	if err != nil {
+		return nil, err
+	}
+
+	q := profileURL.Query()
+	q.Set("limit", strconv.Itoa(RedditPageSize))
+	q.Set("raw_json", "1")
+
+	if len(profileParts) > 2 {
+		q.Set("t", profileParts[2])
+	}
+
+	limit := options.Limit
+	items := make([]*MediaItem, 0, limit)
+
+	for limit > 0 {
+		profileURL.RawQuery = q.Encode()
+
+		pageItems, after, err := ra.fetchItemsForPage(ctx, profileURL.String(), options)
+		if err != nil {
+			return nil, err
+		}
+
+		// Remove any items over limit
+		if len(pageItems) > limit {
+			pageItems = pageItems[:limit]
+		}
+
+		items = append(items, pageItems...)
+		limit -= len(pageItems)
+
+		// API sources drained.
+		if len(after) == 0 {
+			break
+		}
+
+		q.Set("after", after)
+	}
+
+	return items, nil
+}
+
+func (ra *RedditAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+func (ra *RedditAPI) fetchItemsForPage(ctx context.Context, endPoint string, options APIFetchOptions) ([]*MediaItem, string, error) {
+	req, err := http.NewRequest("GET", endPoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Reddit throttles generic user agents.
+	req.Header.Set("User-Agent", "photowall/"+Version)
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errInfo struct {
+			Message string `json:"message"`
+			Reason  string `json:"reason"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&errInfo); err != nil || len(errInfo.Message) == 0 {
+			return nil, "", fmt.Errorf("reddit responded with %q", resp.Status)
+		}
+
+		if len(errInfo.Reason) > 0 {
+			return nil, "", fmt.Errorf("%s (%s)", errInfo.Message, errInfo.Reason)
+		}
+
+		return nil, "", errors.New(errInfo.Message)
+	}
+
+	var listing struct {
+		Data *struct {
+			After    string `json:"after"`
+			Children []*struct {
+				Data *redditPost `json:"data"`
+			} `json:"children"`
+		} `json:"data"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, "", err
+	}
+
+	if listing.Data == nil {
+		return nil, "", nil
+	}
+
+	mediaItems := make([]*MediaItem, 0, len(listing.Data.Children))
+
+	for _, child := range listing.Data.Children {
+		post := child.Data
+
+		if post == nil || post.IsVideo || (post.Over18 && !options.Sensitive) {
+			continue
+		}
+
+		if len(options.Tag) > 0 && !strings.EqualFold(post.LinkFlairText, options.Tag) {
+			continue
+		}
+
+		var postItems []*MediaItem
+
+		if post.IsGallery {
+			postItems = ra.galleryItems(post, options.Size)
+		} else if post.PostHint == "image" && post.Preview != nil && len(post.Preview.Images) > 0 {
+			image := post.Preview.Images[0]
+			if image.Source == nil {
+				continue
+			}
+
+			sizeInfo := ra.findBestSize(image.Source, image.Resolutions, options.Size)
+			postItems = []*MediaItem{{ID: post.ID, URL: sizeInfo.URL, Width: sizeInfo.Width, Height: sizeInfo.Height}}
+		}
+
+		for _, item := range postItems {
+			item.Author = "u/" + post.Author
+			item.AuthorURL = "https://www.reddit.com" + post.Permalink
+			item.Score = post.Score
+		}
+
+		mediaItems = append(mediaItems, postItems...)
+	}
+
+	return mediaItems, listing.Data.After, nil
+}
+
+// galleryItems expands a gallery post into one item per image.
+func (ra *RedditAPI) galleryItems(post *redditPost, size int) []*MediaItem {
+	if post.GalleryData == nil {
+		return nil
+	}
+
+	items := make([]*MediaItem, 0, len(post.GalleryData.Items))
+
+	for _, galleryItem := range post.GalleryData.Items {
+		meta := post.MediaMetadata[galleryItem.MediaID]
+
+		if meta == nil || meta.Status != "valid" || meta.Type != "Image" || meta.Source == nil {
+			continue
+		}
+
+		source := &redditImageSize{meta.Source.URL, meta.Source.Width, meta.Source.Height}
+		resolutions := make([]*redditImageSize, len(meta.Previews))
+
+		for i, p := range meta.Previews {
+			resolutions[i] = &redditImageSize{p.URL, p.Width, p.Height}
+		}
+
+		sizeInfo := ra.findBestSize(source, resolutions, size)
+
+		items = append(items, &MediaItem{
+			ID:     post.ID + "_" + galleryItem.MediaID,
+			URL:    sizeInfo.URL,
+			Width:  sizeInfo.Width,
+			Height: sizeInfo.Height,
+		})
+	}
+
+	return items
+}
+
+// findBestSize returns the smallest resolution which is still larger
+// than the given size. Resolutions are sorted in ascending order.
+func (ra *RedditAPI) findBestSize(source *redditImageSize, resolutions []*redditImageSize, size int) *redditImageSize {
+	sizeInfo := source
+
+	// Search for smaller versions
+	for i := len(resolutions) - 1; i >= 0; i-- {
+		s := resolutions[i]
+
+		if s.Width < size || s.Height < size {
+			break
+		}
+
+		sizeInfo = s
+	}
+
+	return sizeInfo
+}
+
+type redditImageSize struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type redditPost struct {
+	ID            string `json:"id"`
+	Author        string `json:"author"`
+	Permalink     string `json:"permalink"`
+	LinkFlairText string `json:"link_flair_text"`
+	Score         int    `json:"score"`
+	Over18        bool   `json:"over_18"`
+	IsVideo       bool   `json:"is_video"`
+	IsGallery     bool   `json:"is_gallery"`
+	PostHint      string `json:"post_hint"`
+	Preview       *struct {
+		Images []*struct {
+			Source      *redditImageSize   `json:"source"`
+			Resolutions []*redditImageSize `json:"resolutions"`
+		} `json:"images"`
+	} `json:"preview"`
+	GalleryData *struct {
+		Items []*struct {
+			MediaID string `json:"media_id"`
+		} `json:"items"`
+	} `json:"gallery_data"`
+	MediaMetadata map[string]*struct {
+		Status string `json:"status"`
+		Type   string `json:"e"`
+		Source *struct {
+			URL    string `json:"u"`
+			Width  int    `json:"x"`
+			Height int    `json:"y"`
+		} `json:"s"`
+		Previews []*struct {
+			URL    string `json:"u"`
+			Width  int    `json:"x"`
+			Height int    `json:"y"`
+		} `json:"p"`
+	} `json:"media_metadata"`
+}
+
+func NewRedditAPI(string) API {
+	return &RedditAPI{"https://www.reddit.com/r/%s/%s.json"}
+}
+
+func init() {
+	apiFactory.Register("reddit", NewRedditAPI)
+}
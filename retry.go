@@ -0,0 +1,288 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Delay before the first retry, doubled for every further retry
+	RetryBaseDelay = 500 * time.Millisecond
+
+	// Maximum delay between two retries
+	RetryMaxDelay = 30 * time.Second
+
+	// Longer waits requested by Retry-After or rate limit headers
+	// are not worth waiting for and fail the request instead.
+	MaxRateLimitWait = 5 * time.Minute
+)
+
+// retryTransport retries failed requests with exponential backoff and
+// pauses requests to hosts whose rate limit is exhausted.
+type retryTransport struct {
+	Transport http.RoundTripper
+	Retries   int
+
+	mutex       sync.Mutex
+	pausedUntil map[string]time.Time
+	rnd         *rand.Rand
+}
+
+func newRetryTransport(transport http.RoundTripper, retries int) *retryTransport {
+	return &retryTransport{
+		Transport:   transport,
+		Retries:     retries,
+		pausedUntil: make(map[string]time.Time),
+		rnd:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only requests without side effects are retried.
+	retries := t.Retries
+	if (req.Method != "GET" && req.Method != "HEAD") || req.Body != nil {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := t.waitForHost(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.Transport.RoundTrip(req)
+		if err == nil {
+			t.updateRateLimit(req.URL.Host, resp)
+
+			if err = bufferBody(resp); err != nil {
+				resp = nil
+			}
+		}
+
+		delay, retry := t.retryDelay(attempt, resp, err)
+		if !retry || attempt >= retries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		reason := "network error"
+		if err == nil {
+			reason = resp.Status
+			resp.Body.Close()
+		}
+
+		if delay > MaxRateLimitWait {
+			return nil, fmt.Errorf("%s requested to wait %s", req.URL.Host, delay)
+		}
+
+		log.Printf("Retrying %q in %s (%s)", req.URL.String(), delay, reason)
+
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// bufferBody reads the whole response body, so that connections which
+// break during the transfer are retried as well.
+func bufferBody(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+// retryDelay decides whether a request is retried and how long to wait.
+func (t *retryTransport) retryDelay(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		return t.backoff(attempt), isTransientError(err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+	default:
+		return 0, false
+	}
+
+	if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+		return delay, true
+	}
+
+	// Some providers, like reddit, send the rate limit headers with every
+	// response. The reset only matters if the limit is exhausted.
+	if resp.StatusCode == http.StatusTooManyRequests || rateLimitExhausted(resp.Header) {
+		if delay, ok := rateLimitReset(resp.Header); ok {
+			return delay, true
+		}
+	}
+
+	return t.backoff(attempt), true
+}
+
+// backoff returns the exponential backoff delay with jitter. The delay is
+// chosen randomly from the upper half, so that concurrent requests don't
+// retry in lockstep.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := RetryBaseDelay << uint(minInt(attempt, 16))
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+
+	t.mutex.Lock()
+	jitter := time.Duration(t.rnd.Int63n(int64(delay/2) + 1))
+	t.mutex.Unlock()
+
+	return delay/2 + jitter
+}
+
+// waitForHost blocks while the rate limit of the request's host
+// is exhausted.
+func (t *retryTransport) waitForHost(req *http.Request) error {
+	host := req.URL.Host
+
+	t.mutex.Lock()
+	until := t.pausedUntil[host]
+	t.mutex.Unlock()
+
+	wait := durationUntil(until)
+	if wait <= 0 {
+		return nil
+	}
+
+	if wait > MaxRateLimitWait {
+		return fmt.Errorf("Rate limit of %s exhausted, resets in %s", host, wait)
+	}
+
+	log.Printf("Rate limit of %s exhausted, pausing for %s", host, wait)
+	return sleepContext(req.Context(), wait)
+}
+
+// sleepContext pauses for the duration unless the context
+// is canceled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// updateRateLimit pauses further requests to the host if the response
+// reports that no requests are remaining.
+func (t *retryTransport) updateRateLimit(host string, resp *http.Response) {
+	if !rateLimitExhausted(resp.Header) {
+		return
+	}
+
+	delay, ok := rateLimitReset(resp.Header)
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	t.pausedUntil[host] = time.Now().Add(delay)
+	t.mutex.Unlock()
+}
+
+// rateLimitExhausted reports whether the response reports that no
+// requests are remaining.
+func rateLimitExhausted(header http.Header) bool {
+	value := header.Get("X-RateLimit-Remaining")
+	if len(value) == 0 {
+		return false
+	}
+
+	// Some providers, like reddit, use fractional numbers.
+	remaining, err := strconv.ParseFloat(value, 64)
+	return err == nil && remaining < 1
+}
+
+// parseRetryAfter parses the Retry-After header, which is either
+// a number of seconds or a HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(maxInt(seconds, 0)) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return durationUntil(date), true
+	}
+
+	return 0, false
+}
+
+// rateLimitReset returns the time until the rate limit resets. Providers
+// report either a unix timestamp, the remaining seconds or a date.
+func rateLimitReset(header http.Header) (time.Duration, bool) {
+	value := strings.TrimSpace(header.Get("X-RateLimit-Reset"))
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		// Anything larger than a year of seconds is a timestamp.
+		if seconds > 365*24*60*60 {
+			return durationUntil(time.Unix(int64(seconds), 0)), true
+		}
+
+		if seconds < 0 {
+			seconds = 0
+		}
+
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return durationUntil(date), true
+	}
+
+	return 0, false
+}
+
+// durationUntil returns the time until t, or zero if t has passed.
+func durationUntil(t time.Time) time.Duration {
+	if d := t.Sub(time.Now()); d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+// isTransientError reports whether a request failed because of
+// a network problem which may go away when trying again.
+func isTransientError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
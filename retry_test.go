@@ -0,0 +1,122 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	transport := newRetryTransport(nil, 3)
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name    string
+		status  int
+		header  map[string]string
+		err     error
+		retry   bool
+		delay   time.Duration // exact delay, zero for backoff
+		attempt int
+	}{
+		{name: "not found", status: 404},
+		{name: "not implemented", status: 501},
+		{name: "bad gateway", status: 502, retry: true},
+		{name: "unexpected eof", err: io.ErrUnexpectedEOF, retry: true},
+		{name: "other error", err: errors.New("broken")},
+		{name: "retry after seconds", status: 503, header: map[string]string{"Retry-After": "3"}, retry: true, delay: 3 * time.Second},
+		{name: "too many requests with reset", status: 429, header: map[string]string{"X-RateLimit-Reset": "420"}, retry: true, delay: 7 * time.Minute},
+		{name: "exhausted with reset", status: 503, header: map[string]string{"X-RateLimit-Remaining": "0.0", "X-RateLimit-Reset": "60"}, retry: true, delay: time.Minute},
+		{name: "remaining quota ignores reset", status: 503, header: map[string]string{"X-RateLimit-Remaining": "95", "X-RateLimit-Reset": "420"}, retry: true},
+		{name: "no remaining header ignores reset", status: 500, header: map[string]string{"X-RateLimit-Reset": reset}, retry: true, attempt: 2},
+	}
+
+	for _, test := range tests {
+		var resp *http.Response
+		if test.err == nil {
+			resp = &http.Response{StatusCode: test.status, Header: http.Header{}}
+			for name, value := range test.header {
+				resp.Header.Set(name, value)
+			}
+		}
+
+		delay, retry := transport.retryDelay(test.attempt, resp, test.err)
+
+		if retry != test.retry {
+			t.Errorf("%s: retry = %t, want %t", test.name, retry, test.retry)
+			continue
+		}
+
+		if !retry {
+			continue
+		}
+
+		if test.delay > 0 {
+			if delay != test.delay {
+				t.Errorf("%s: delay = %s, want %s", test.name, delay, test.delay)
+			}
+
+			continue
+		}
+
+		max := RetryBaseDelay << uint(test.attempt)
+		if delay < max/2 || delay > max {
+			t.Errorf("%s: backoff = %s, want between %s and %s", test.name, delay, max/2, max)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-5", 0, true},
+		{"soon", 0, false},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0, true},
+	}
+
+	for _, test := range tests {
+		delay, ok := parseRetryAfter(test.value)
+		if delay != test.delay || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %t, want %s, %t", test.value, delay, ok, test.delay, test.ok)
+		}
+	}
+}
+
+func TestRateLimitReset(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+		ok    bool
+	}{
+		{"", 0, 0, false},
+		{"30", 30 * time.Second, 30 * time.Second, true},
+		{"1.5", 1500 * time.Millisecond, 1500 * time.Millisecond, true},
+		{strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10), 59 * time.Minute, time.Hour, true},
+		{time.Now().Add(time.Hour).Format(time.RFC3339), 59 * time.Minute, time.Hour, true},
+		{"2006-01-02T15:04:05Z", 0, 0, true},
+		{"later", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set("X-RateLimit-Reset", test.value)
+
+		delay, ok := rateLimitReset(header)
+		if ok != test.ok || delay < test.min || delay > test.max {
+			t.Errorf("rateLimitReset(%q) = %s, %t, want %s..%s, %t", test.value, delay, ok, test.min, test.max, test.ok)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var rssImgTag = regexp.MustCompile(`(?i)<img[^>]+src\s*=\s*["']([^"']+)["']`)
+
+type rssLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type rssMedia struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Medium string `xml:"medium,attr"`
+	Width  int    `xml:"width,attr"`
+	Height int    `xml:"height,attr"`
+}
+
+type rssEntry struct {
+	GUID            string      `xml:"guid"`
+	ID              string      `xml:"id"`
+	Links           []*rssLink  `xml:"link"`
+	Enclosures      []*rssMedia `xml:"enclosure"`
+	MediaContents   []*rssMedia `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaThumbnails []*rssMedia `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	MediaGroups     []*struct {
+		Contents   []*rssMedia `xml:"http://search.yahoo.com/mrss/ content"`
+		Thumbnails []*rssMedia `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	} `xml:"http://search.yahoo.com/mrss/ group"`
+	Description string `xml:"description"`
+	Encoded     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Content     string `xml:"http://www.w3.org/2005/Atom content"`
+	Summary     string `xml:"http://www.w3.org/2005/Atom summary"`
+}
+
+type rssFeed struct {
+	// RSS 2.0
+	Channel *struct {
+		Links []*rssLink  `xml:"http://www.w3.org/2005/Atom link"`
+		Items []*rssEntry `xml:"item"`
+	} `xml:"channel"`
+
+	// RSS 1.0 places the items next to the channel.
+	Items []*rssEntry `xml:"item"`
+
+	// Atom
+	Links   []*rssLink  `xml:"http://www.w3.org/2005/Atom link"`
+	Entries []*rssEntry `xml:"http://www.w3.org/2005/Atom entry"`
+}
+
+type RSSAPI struct{}
+
+func (ra *RSSAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	feedURL, err := ra.feedURL(options.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*MediaItem, 0, options.Limit)
+	visited := make(map[string]bool)
+
+	for feedURL != nil && len(items) < options.Limit {
+		// Protect against feeds linking back to previous pages.
+		if visited[feedURL.String()] {
+			break
+		}
+
+		visited[feedURL.String()] = true
+
+		pageItems, next, err := ra.fetchItemsForPage(ctx, feedURL, options.Size)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range pageItems {
+			if len(items) == options.Limit {
+				break
+			}
+
+			items = append(items, item)
+		}
+
+		feedURL = next
+	}
+
+	return items, nil
+}
+
+func (ra *RSSAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+// feedURL turns the profile into a feed URL. Profiles without
+// a scheme are treated as paths to local feed files.
+func (ra *RSSAPI) feedURL(profile string) (*url.URL, error) {
+	u, err := url.Parse(profile)
+	if err == nil && len(u.Scheme) > 1 {
+		return u, nil
+	}
+
+	abs, err := filepath.Abs(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}, nil
+}
+
+func (ra *RSSAPI) fetchItemsForPage(ctx context.Context, feedURL *url.URL, size int) ([]*MediaItem, *url.URL, error) {
+	body, err := openMediaURL(ctx, feedURL.String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer body.Close()
+
+	var feed rssFeed
+
+	if err := xml.NewDecoder(body).Decode(&feed); err != nil {
+		return nil, nil, fmt.Errorf("Invalid feed %q, %s", feedURL, err.Error())
+	}
+
+	entries := append(feed.Items, feed.Entries...)
+	links := feed.Links
+
+	if feed.Channel != nil {
+		entries = append(feed.Channel.Items, entries...)
+		links = append(links, feed.Channel.Links...)
+	}
+
+	mediaItems := make([]*MediaItem, 0, len(entries))
+
+	for _, entry := range entries {
+		media := ra.findBestMedia(entry, size)
+		if media == nil {
+			continue
+		}
+
+		mediaURL, err := feedURL.Parse(media.URL)
+		if err != nil {
+			continue
+		}
+
+		// GUIDs are often URLs, so hash them to get a valid file name.
+		id := ra.entryID(entry, mediaURL.String())
+
+		mediaItems = append(mediaItems, &MediaItem{
+			ID:     fmt.Sprintf("%x", sha1.Sum([]byte(id))),
+			URL:    mediaURL.String(),
+			Width:  media.Width,
+			Height: media.Height,
+		})
+	}
+
+	var next *url.URL
+
+	for _, link := range links {
+		if link.Rel == "next" && len(link.Href) > 0 {
+			if next, err = feedURL.Parse(link.Href); err != nil {
+				return nil, nil, err
+			}
+
+			break
+		}
+	}
+
+	return mediaItems, next, nil
+}
+
+func (ra *RSSAPI) entryID(entry *rssEntry, mediaURL string) string {
+	if id := strings.TrimSpace(entry.GUID); len(id) > 0 {
+		return id
+	}
+
+	if id := strings.TrimSpace(entry.ID); len(id) > 0 {
+		return id
+	}
+
+	return mediaURL
+}
+
+// findBestMedia returns the smallest image of an entry that is at least
+// of the given size. Images without size information are preferred
+// over images which are known to be too small.
+func (ra *RSSAPI) findBestMedia(entry *rssEntry, size int) *rssMedia {
+	var candidates []*rssMedia
+
+	candidates = append(candidates, entry.MediaContents...)
+
+	for _, group := range entry.MediaGroups {
+		candidates = append(candidates, group.Contents...)
+	}
+
+	candidates = append(candidates, entry.Enclosures...)
+
+	for _, link := range entry.Links {
+		if link.Rel == "enclosure" {
+			candidates = append(candidates, &rssMedia{URL: link.Href, Type: link.Type})
+		}
+	}
+
+	for _, content := range []string{entry.Encoded, entry.Content, entry.Description, entry.Summary} {
+		for _, match := range rssImgTag.FindAllStringSubmatch(content, -1) {
+			candidates = append(candidates, &rssMedia{URL: html.UnescapeString(match[1]), Medium: "image"})
+		}
+	}
+
+	// Thumbnails are the last resort.
+	candidates = append(candidates, entry.MediaThumbnails...)
+
+	for _, group := range entry.MediaGroups {
+		candidates = append(candidates, group.Thumbnails...)
+	}
+
+	var best, largest, unsized *rssMedia
+
+	for _, c := range candidates {
+		if len(c.URL) == 0 || !ra.isImage(c) {
+			continue
+		}
+
+		if c.Width == 0 || c.Height == 0 {
+			if unsized == nil {
+				unsized = c
+			}
+
+			continue
+		}
+
+		if c.Width >= size && c.Height >= size && (best == nil || c.Width < best.Width) {
+			best = c
+		}
+
+		if largest == nil || c.Width > largest.Width {
+			largest = c
+		}
+	}
+
+	switch {
+	case best != nil:
+		return best
+	case unsized != nil:
+		return unsized
+	}
+
+	return largest
+}
+
+func (ra *RSSAPI) isImage(media *rssMedia) bool {
+	if len(media.Medium) > 0 {
+		return media.Medium == "image"
+	}
+
+	if len(media.Type) > 0 {
+		return strings.HasPrefix(media.Type, "image/")
+	}
+
+	// Guess by file extension
+	u, err := url.Parse(media.URL)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mime.TypeByExtension(strings.ToLower(path.Ext(u.Path))), "image/")
+}
+
+func NewRSSAPI(string) API {
+	return &RSSAPI{}
+}
+
+func init() {
+	apiFactory.Register("rss", NewRSSAPI)
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// rssTestItem is the expected item, its ID is the hash of id.
+type rssTestItem struct {
+	id, url       string
+	width, height int
+}
+
+func TestRSSAPI(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages map[string]string
+		size  int
+		limit int
+		want  []rssTestItem
+	}{
+		{
+			name: "rss enclosures",
+			pages: map[string]string{"/feed": `<rss version="2.0"><channel>
+				<item><guid>tag:a</guid><enclosure url="/a.jpg" type="image/jpeg"/></item>
+				<item><guid>tag:b</guid><enclosure url="/b.mp3" type="audio/mpeg"/></item>
+				<item><enclosure url="http://example.com/c.png" type="image/png"/></item>
+			</channel></rss>`},
+			limit: 10,
+			want: []rssTestItem{
+				{"tag:a", "{server}/a.jpg", 0, 0},
+				{"http://example.com/c.png", "http://example.com/c.png", 0, 0},
+			},
+		},
+		{
+			name: "atom links",
+			pages: map[string]string{"/feed": `<feed xmlns="http://www.w3.org/2005/Atom">
+				<entry><id>urn:1</id><link rel="alternate" href="/post/1"/><link rel="enclosure" href="/1.png" type="image/png"/></entry>
+				<entry><id>urn:2</id><content type="html">&lt;p&gt;&lt;img src="/2.jpg"&gt;&lt;/p&gt;</content></entry>
+			</feed>`},
+			limit: 10,
+			want: []rssTestItem{
+				{"urn:1", "{server}/1.png", 0, 0},
+				{"urn:2", "{server}/2.jpg", 0, 0},
+			},
+		},
+		{
+			name: "media rss dimensions",
+			pages: map[string]string{"/feed": `<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/"><channel>
+				<item><guid>m</guid>
+					<media:content url="/small.jpg" medium="image" width="100" height="80"/>
+					<media:content url="/medium.jpg" medium="image" width="400" height="300"/>
+					<media:content url="/large.jpg" medium="image" width="1600" height="1200"/>
+				</item>
+				<item><guid>n</guid>
+					<media:content url="/tiny.jpg" medium="image" width="50" height="40"/>
+					<media:content url="/clip.mp4" medium="video" width="1920" height="1080"/>
+				</item>
+			</channel></rss>`},
+			size:  250,
+			limit: 10,
+			want: []rssTestItem{
+				{"m", "{server}/medium.jpg", 400, 300},
+				{"n", "{server}/tiny.jpg", 50, 40},
+			},
+		},
+		{
+			name: "next pages",
+			pages: map[string]string{
+				"/feed": `<feed xmlns="http://www.w3.org/2005/Atom">
+					<link rel="next" href="/feed?page=2"/>
+					<entry><id>1</id><link rel="enclosure" href="/1.jpg" type="image/jpeg"/></entry>
+				</feed>`,
+				"/feed?page=2": `<feed xmlns="http://www.w3.org/2005/Atom">
+					<link rel="next" href="/feed"/>
+					<entry><id>2</id><link rel="enclosure" href="/2.jpg" type="image/jpeg"/></entry>
+				</feed>`,
+			},
+			limit: 10,
+			want: []rssTestItem{
+				{"1", "{server}/1.jpg", 0, 0},
+				{"2", "{server}/2.jpg", 0, 0},
+			},
+		},
+		{
+			name: "limit",
+			pages: map[string]string{
+				"/feed": `<feed xmlns="http://www.w3.org/2005/Atom">
+					<link rel="next" href="/feed?page=2"/>
+					<entry><id>1</id><link rel="enclosure" href="/1.jpg" type="image/jpeg"/></entry>
+					<entry><id>2</id><link rel="enclosure" href="/2.jpg" type="image/jpeg"/></entry>
+				</feed>`,
+			},
+			limit: 1,
+			want: []rssTestItem{
+				{"1", "{server}/1.jpg", 0, 0},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			page, ok := test.pages[r.URL.RequestURI()]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+
+			fmt.Fprint(w, page)
+		}))
+
+		items, err := (&RSSAPI{}).FetchMediaItems(context.Background(), APIFetchOptions{
+			Profile: server.URL + "/feed",
+			Size:    test.size,
+			Limit:   test.limit,
+		})
+		server.Close()
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if len(items) != len(test.want) {
+			t.Errorf("%s: %d items, want %d", test.name, len(items), len(test.want))
+			continue
+		}
+
+		for i, want := range test.want {
+			item := items[i]
+			wantURL := strings.Replace(want.url, "{server}", server.URL, 1)
+
+			// GUIDs are hashed, as they are often URLs.
+			if id := fmt.Sprintf("%x", sha1.Sum([]byte(strings.Replace(want.id, "{server}", server.URL, 1)))); item.ID != id {
+				t.Errorf("%s: item %d has ID %q, want the hash of %q", test.name, i, item.ID, want.id)
+			}
+
+			if item.URL != wantURL || item.Width != want.width || item.Height != want.height {
+				t.Errorf("%s: item %d is %s (%dx%d), want %s (%dx%d)",
+					test.name, i, item.URL, item.Width, item.Height, wantURL, want.width, want.height)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Exit status after SIGINT or SIGTERM, as reported by shells
+	ExitInterrupted = 130
+
+	// Exit status after the -timeout expired, like timeout(1)
+	ExitTimeout = 124
+)
+
+var (
+	shutdownCtx    = context.Background()
+	shutdownMutex  sync.Mutex
+	shutdownSignal os.Signal
+)
+
+// setupShutdown returns the context of the run. It is canceled on SIGINT
+// or SIGTERM and when the timeout expires. A second signal exits
+// immediately.
+func setupShutdown(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+
+		shutdownMutex.Lock()
+		shutdownSignal = sig
+		shutdownMutex.Unlock()
+
+		log.Printf("Received %s, stopping", sig)
+		cancel()
+
+		<-signals
+		log.Printf("Received second signal, exiting immediately")
+		exitCanceled()
+	}()
+
+	shutdownCtx = ctx
+	return ctx, cancel
+}
+
+// exitIfCanceled exits once the run is canceled. It is called between
+// the steps of a run, when no files are being written.
+func exitIfCanceled(ctx context.Context) {
+	if ctx.Err() != nil {
+		exitCanceled()
+	}
+}
+
+func exitCanceled() {
+	shutdownMutex.Lock()
+	sig := shutdownSignal
+	shutdownMutex.Unlock()
+
+	status := ExitInterrupted
+	if sig != nil {
+		log.Printf("Interrupted")
+	} else {
+		log.Printf("Timeout of %s exceeded", runTimeout)
+		status = ExitTimeout
+	}
+
+	removeAllTempFiles()
+	releaseLock()
+	os.Exit(status)
+}
+
+// removeAllTempFiles removes the temporary files of writes which
+// were cut short by the cancellation.
+func removeAllTempFiles() {
+	if len(cacheDir) == 0 {
+		return
+	}
+
+	removeTempFiles(cacheDir)
+
+	files, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			removeTempFiles(filepath.Join(cacheDir, file.Name()))
+		}
+	}
+}
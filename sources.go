@@ -0,0 +1,383 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Source is a single API profile the wallpaper is composed of.
+type Source struct {
+	APIName string
+	API     API
+	Profile string
+	Tag     string
+	Weight  int
+
+	// Cache directory of the source's images
+	CacheDir string
+}
+
+func (s *Source) String() string {
+	if len(s.Tag) > 0 {
+		return fmt.Sprintf("%s:%s#%s", s.APIName, s.Profile, s.Tag)
+	}
+
+	return fmt.Sprintf("%s:%s", s.APIName, s.Profile)
+}
+
+// sourceSpecs collects the repeated -source flags.
+type sourceSpecs []string
+
+func (s *sourceSpecs) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *sourceSpecs) Set(spec string) error {
+	*s = append(*s, spec)
+	return nil
+}
+
+// parseSourceSpec parses a source in the format api:profile[#tag].
+// The profile may contain colons itself, e.g. 500px:user:jondoe.
+func parseSourceSpec(spec string) (*Source, error) {
+	parts := strings.SplitN(spec, ":", 2)
+
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("Source %q not in format <api>:<profile>[#<tag>]", spec)
+	}
+
+	source := &Source{APIName: parts[0], Profile: parts[1], Weight: 1}
+
+	if i := strings.LastIndex(source.Profile, "#"); i >= 0 {
+		source.Tag = source.Profile[i+1:]
+		source.Profile = source.Profile[:i]
+	}
+
+	return source, nil
+}
+
+// apiKeys returns the keys of the -key option by API name. The option
+// either holds a single key used for all APIs, returned with an empty
+// name, or a comma separated list of api=key pairs.
+func apiKeys() map[string]string {
+	keys := make(map[string]string)
+
+	for _, part := range strings.Split(apiKey, ",") {
+		pair := strings.SplitN(part, "=", 2)
+
+		if len(pair) == 2 && apiFactory.apis[pair[0]] != nil {
+			keys[pair[0]] = pair[1]
+		}
+	}
+
+	if len(keys) == 0 {
+		keys[""] = apiKey
+	}
+
+	return keys
+}
+
+// apiKeyFor returns the key of the named API.
+func apiKeyFor(name string) string {
+	keys := apiKeys()
+
+	if key, ok := keys[""]; ok {
+		return key
+	}
+
+	return keys[name]
+}
+
+func parseSourceOptions() []*Source {
+	var sources []*Source
+
+	if len(sourceSpecList) == 0 {
+		requiredOption("profile", profile)
+
+		sources = append(sources, &Source{APIName: apiName, Profile: profile, Tag: tag, Weight: 1})
+	}
+
+	for _, spec := range sourceSpecList {
+		source, err := parseSourceSpec(spec)
+		fatalIf(err)
+
+		sources = append(sources, source)
+	}
+
+	if len(sourceWeights) > 0 {
+		weights := strings.Split(sourceWeights, ",")
+		if len(weights) != len(sources) {
+			fatalIf(fmt.Errorf("Expected %d weights, one per source", len(sources)))
+		}
+
+		for i, w := range weights {
+			weight, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil || weight <= 0 {
+				fatalIf(fmt.Errorf("Invalid weight %q", w))
+			}
+
+			sources[i].Weight = weight
+		}
+	}
+
+	for _, source := range sources {
+		source.API = apiFactory.Create(source.APIName, apiKeyFor(source.APIName))
+		if source.API == nil {
+			fatalIf(fmt.Errorf("%q API not supported", source.APIName))
+		}
+	}
+
+	return sources
+}
+
+// reconcileSquareTiles decides whether square tiles must be used. Images
+// of square only APIs fit into non-square grids as well, so square tiles
+// are only enforced if every source supports nothing else.
+func reconcileSquareTiles(sources []*Source) {
+	if squareTiles {
+		return
+	}
+
+	var squareOnly []string
+
+	for _, source := range sources {
+		if source.API.SupportsOnlySquareImages() {
+			squareOnly = append(squareOnly, source.APIName)
+		}
+	}
+
+	if len(squareOnly) == 0 {
+		return
+	}
+
+	if len(squareOnly) == len(sources) {
+		log.Printf("The %q API supports only square tiles - falling back", strings.Join(squareOnly, ", "))
+		squareTiles = true
+		return
+	}
+
+	log.Printf("The %q API supports only square tiles - using them as square images", strings.Join(squareOnly, ", "))
+}
+
+// fetchSources fetches the items of all sources concurrently and interleaves
+// them by their weights. Each source is asked for its weighted share of
+// the limit. Failing sources are skipped unless all of them fail. If the
+// sources return less than the limit, the ones which filled their share
+// are asked for the missing items.
+func fetchSources(ctx context.Context, sources []*Source, options APIFetchOptions) ([]*MediaItem, error) {
+	totalWeight := 0
+	for _, source := range sources {
+		totalWeight += source.Weight
+	}
+
+	results := make([][]*MediaItem, len(sources))
+	errs := make([]error, len(sources))
+	limits := make([]int, len(sources))
+
+	// Set once a source has no more items.
+	drained := make([]bool, len(sources))
+
+	for i, source := range sources {
+		limits[i] = ceilIntDivision(options.Limit*source.Weight, totalWeight)
+	}
+
+	fetchSourceItems(ctx, sources, options, limits, results, errs)
+
+	// Partial results are useless once the run is canceled.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	failed := 0
+	for i, err := range errs {
+		if err == nil {
+			log.Printf("Fetched %d media items from %s", len(results[i]), sources[i])
+			continue
+		}
+
+		if len(sources) == 1 {
+			return nil, err
+		}
+
+		log.Printf("Error: Failed to fetch %s, %s", sources[i], err.Error())
+		failed++
+	}
+
+	if failed == len(sources) {
+		return nil, fmt.Errorf("All sources failed")
+	}
+
+	for {
+		missing := options.Limit
+		for _, items := range results {
+			missing -= len(items)
+		}
+
+		if missing <= 0 {
+			break
+		}
+
+		// Only sources which returned their full share may have more
+		// items. Their shares are raised by their part of the missing
+		// items, weighted among themselves.
+		more := make([]int, len(sources))
+		moreWeight := 0
+
+		for i, source := range sources {
+			if errs[i] != nil || len(results[i]) < limits[i] {
+				drained[i] = true
+			}
+
+			if !drained[i] {
+				moreWeight += source.Weight
+			}
+		}
+
+		if moreWeight == 0 {
+			break
+		}
+
+		for i, source := range sources {
+			if !drained[i] {
+				limits[i] += ceilIntDivision(missing*source.Weight, moreWeight)
+				more[i] = limits[i]
+			}
+		}
+
+		moreResults := make([][]*MediaItem, len(sources))
+		moreErrs := make([]error, len(sources))
+
+		fetchSourceItems(ctx, sources, options, more, moreResults, moreErrs)
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for i := range sources {
+			if more[i] == 0 {
+				continue
+			}
+
+			// Keep what the source returned before, it isn't asked again.
+			if moreErrs[i] != nil {
+				log.Printf("Error: Failed to fetch more from %s, %s", sources[i], moreErrs[i].Error())
+				drained[i] = true
+				continue
+			}
+
+			// The APIs start with the newest items every time, so
+			// the new result includes the previous one.
+			if len(moreResults[i]) <= len(results[i]) {
+				drained[i] = true
+				continue
+			}
+
+			log.Printf("Fetched %d more media items from %s", len(moreResults[i])-len(results[i]), sources[i])
+			results[i] = moreResults[i]
+		}
+	}
+
+	return interleaveItems(results, sources, options.Limit), nil
+}
+
+// fetchSourceItems fetches the sources with a non-zero limit concurrently
+// and stores their items and errors by index.
+func fetchSourceItems(ctx context.Context, sources []*Source, options APIFetchOptions, limits []int, results [][]*MediaItem, errs []error) {
+	var fetches sync.WaitGroup
+
+	for i, source := range sources {
+		if limits[i] == 0 {
+			continue
+		}
+
+		fetches.Add(1)
+
+		go func(i int, source *Source) {
+			defer fetches.Done()
+
+			sourceOptions := options
+			sourceOptions.Profile = source.Profile
+			sourceOptions.Tag = source.Tag
+			sourceOptions.Limit = limits[i]
+
+			results[i], errs[i] = source.API.FetchMediaItems(ctx, sourceOptions)
+
+			for _, item := range results[i] {
+				item.Source = source
+			}
+		}(i, source)
+	}
+
+	fetches.Wait()
+}
+
+// fetchMoreItems fetches the sources again and returns the items which
+// aren't known yet. The APIs start with the newest items every time, so
+// the limit of the options has to include the known items.
+func fetchMoreItems(ctx context.Context, sources []*Source, options APIFetchOptions, known []*MediaItem) []*MediaItem {
+	items, err := fetchSources(ctx, sources, options)
+	if err != nil {
+		log.Printf("Error: Failed to fetch more images, %s", err.Error())
+		return nil
+	}
+
+	seen := make(map[string]bool, len(known))
+	for _, item := range known {
+		seen[item.cachePath()] = true
+	}
+
+	var newItems []*MediaItem
+
+	for _, item := range items {
+		if !seen[item.cachePath()] {
+			seen[item.cachePath()] = true
+			newItems = append(newItems, item)
+		}
+	}
+
+	log.Printf("Fetched %d more media items", len(newItems))
+	return newItems
+}
+
+// interleaveItems merges the items of all sources using a smooth weighted
+// round robin, so that items of heavier sources are evenly spread.
+func interleaveItems(results [][]*MediaItem, sources []*Source, limit int) []*MediaItem {
+	items := make([]*MediaItem, 0, limit)
+	current := make([]int, len(sources))
+
+	for len(items) < limit {
+		best, totalWeight := -1, 0
+
+		for i, source := range sources {
+			if len(results[i]) == 0 {
+				continue
+			}
+
+			current[i] += source.Weight
+			totalWeight += source.Weight
+
+			if best < 0 || current[i] > current[best] {
+				best = i
+			}
+		}
+
+		// All sources drained
+		if best < 0 {
+			break
+		}
+
+		current[best] -= totalWeight
+		items = append(items, results[best][0])
+		results[best] = results[best][1:]
+	}
+
+	return items
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// testAPI returns up to total items, newest first, like the real APIs.
+type testAPI struct {
+	total int
+	err   error
+
+	mu       sync.Mutex
+	requests int
+}
+
+func (ta *testAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	ta.mu.Lock()
+	ta.requests++
+	ta.mu.Unlock()
+
+	if ta.err != nil {
+		return nil, ta.err
+	}
+
+	items := make([]*MediaItem, 0, minInt(options.Limit, ta.total))
+	for i := 0; i < options.Limit && i < ta.total; i++ {
+		items = append(items, &MediaItem{ID: fmt.Sprintf("%s-%d", options.Profile, i)})
+	}
+
+	return items, nil
+}
+
+func (ta *testAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+func TestFetchSources(t *testing.T) {
+	failing := errors.New("down")
+
+	tests := []struct {
+		name     string
+		totals   []int
+		weights  []int
+		failing  int
+		limit    int
+		items    []int
+		requests []int
+	}{
+		{"shares", []int{100, 100, 100}, []int{1, 1, 1}, -1, 9, []int{3, 3, 3}, []int{1, 1, 1}},
+		{"top up", []int{1, 100, 100}, []int{1, 1, 1}, -1, 9, []int{1, 4, 4}, []int{1, 2, 2}},
+		{"weighted top up", []int{0, 100, 100}, []int{2, 1, 1}, -1, 8, []int{0, 4, 4}, []int{1, 2, 2}},
+		{"failed source", []int{100, 100}, []int{1, 1}, 0, 6, []int{0, 6}, []int{1, 2}},
+		{"all short", []int{1, 2}, []int{1, 1}, -1, 10, []int{1, 2}, []int{1, 1}},
+		{"drained on top up", []int{0, 5}, []int{1, 1}, -1, 10, []int{0, 5}, []int{1, 2}},
+	}
+
+	for _, test := range tests {
+		apis := make([]*testAPI, len(test.totals))
+		sources := make([]*Source, len(test.totals))
+
+		for i, total := range test.totals {
+			apis[i] = &testAPI{total: total}
+			if i == test.failing {
+				apis[i].err = failing
+			}
+
+			sources[i] = &Source{APIName: "test", API: apis[i], Profile: fmt.Sprint(i), Weight: test.weights[i]}
+		}
+
+		items, err := fetchSources(context.Background(), sources, APIFetchOptions{Limit: test.limit})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		counts := make([]int, len(sources))
+		seen := make(map[string]bool)
+
+		for _, item := range items {
+			if seen[item.ID] {
+				t.Errorf("%s: item %q returned twice", test.name, item.ID)
+			}
+
+			seen[item.ID] = true
+
+			var source int
+			fmt.Sscanf(item.ID, "%d-", &source)
+			counts[source]++
+		}
+
+		for i := range sources {
+			if counts[i] != test.items[i] || apis[i].requests != test.requests[i] {
+				t.Errorf("%s: source %d has %d items in %d requests, want %d in %d",
+					test.name, i, counts[i], apis[i].requests, test.items[i], test.requests[i])
+			}
+		}
+	}
+}
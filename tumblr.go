@@ -5,7 +5,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -19,11 +21,9 @@ type TumblrAPI struct {
 	BaseURL string
 }
 
-func (ta *TumblrAPI) FetchMediaItems(options APIFetchOptions) ([]*MediaItem, error) {
+func (ta *TumblrAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
 	limit := options.Limit
-	pages := ceilIntDivision(limit, TumblrPageSize)
-	pageSize := TumblrPageSize
-	var items []*MediaItem
+	items := make([]*MediaItem, 0, limit)
 
 	profileURL, err := url.Parse(fmt.Sprintf(ta.BaseURL, options.Profile))
 	if err != nil {
@@ -36,41 +36,45 @@ func (ta *TumblrAPI) FetchMediaItems(options APIFetchOptions) ([]*MediaItem, err
 	q.Set("api_key", ta.Key)
 
 	// Set tag filter if specified.
-	if len(tag) > 0 {
+	if len(options.Tag) > 0 {
 		q.Set("tag", options.Tag)
 	}
 
-	for p := 0; p < pages; p++ {
-		if limit < TumblrPageSize {
-			pageSize = limit
-		}
+	q.Set("limit", strconv.Itoa(TumblrPageSize))
 
-		q.Set("offset", strconv.Itoa(p*TumblrPageSize))
-		q.Set("limit", strconv.Itoa(pageSize))
+	// Posts without photos are skipped, so the offset counts posts
+	// rather than items.
+	for offset := 0; limit > 0; offset += TumblrPageSize {
+		q.Set("offset", strconv.Itoa(offset))
 
 		profileURL.RawQuery = q.Encode()
 
-		itms, err := ta.fetchItemsForPage(profileURL.String(), options.Size)
+		pageItems, posts, err := ta.fetchItemsForPage(ctx, profileURL.String(), options.Size)
 		if err != nil {
 			return nil, err
 		}
 
+		// Remove any items over limit
+		if len(pageItems) > limit {
+			pageItems = pageItems[:limit]
+		}
+
+		items = append(items, pageItems...)
+		limit -= len(pageItems)
+
 		// API sources drained
-		if len(itms) == 0 {
+		if posts < TumblrPageSize {
 			break
 		}
-
-		items = append(items, itms...)
-		limit -= len(itms)
 	}
 
 	return items, nil
 }
 
-func (ta *TumblrAPI) fetchItemsForPage(endPoint string, size int) ([]*MediaItem, error) {
-	resp, err := http.Get(endPoint)
+func (ta *TumblrAPI) fetchItemsForPage(ctx context.Context, endPoint string, size int) ([]*MediaItem, int, error) {
+	resp, err := httpGet(ctx, endPoint)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	defer resp.Body.Close()
@@ -82,18 +86,19 @@ func (ta *TumblrAPI) fetchItemsForPage(endPoint string, size int) ([]*MediaItem,
 			} `json:"meta"`
 		}
 
-		if err := json.NewDecoder(resp.Body).Decode(&errInfo); err != nil {
-			return nil, err
+		if err := json.NewDecoder(resp.Body).Decode(&errInfo); err != nil || errInfo.Meta == nil {
+			return nil, 0, fmt.Errorf("Tumblr responded with %q", resp.Status)
 		}
 
-		return nil, fmt.Errorf(errInfo.Meta.Msg)
+		return nil, 0, errors.New(errInfo.Meta.Msg)
 	}
 
 	var media struct {
 		Response *struct {
 			Posts []*struct {
-				ID     int `json:"id"`
-				Photos []*struct {
+				ID        int `json:"id"`
+				NoteCount int `json:"note_count"`
+				Photos    []*struct {
 					AltSizes []*struct {
 						URL    string `json:"url"`
 						Width  int    `json:"width"`
@@ -110,15 +115,24 @@ func (ta *TumblrAPI) fetchItemsForPage(endPoint string, size int) ([]*MediaItem,
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&media); err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	if media.Response == nil {
+		return nil, 0, nil
 	}
 
 	// Prealloc mediaItems
 	mediaItems := make([]*MediaItem, 0, len(media.Response.Posts))
 
 	for _, post := range media.Response.Posts {
+		if len(post.Photos) == 0 || post.Photos[0].OriginalSize == nil {
+			continue
+		}
+
 		item := &MediaItem{}
 		item.ID = strconv.Itoa(post.ID)
+		item.Score = post.NoteCount
 
 		photo := post.Photos[0]
 		sizeInfo := photo.OriginalSize
@@ -139,7 +153,7 @@ func (ta *TumblrAPI) fetchItemsForPage(endPoint string, size int) ([]*MediaItem,
 		mediaItems = append(mediaItems, item)
 	}
 
-	return mediaItems, nil
+	return mediaItems, len(media.Response.Posts), nil
 }
 
 func (ta *TumblrAPI) SupportsOnlySquareImages() bool {
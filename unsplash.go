@@ -0,0 +1,218 @@
+// Copyright 2016 Marcel Gotsch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const UnsplashPageSize = 30
+
+type UnsplashAPI struct {
+	Key     string
+	BaseURL string
+}
+
+func (ua *UnsplashAPI) FetchMediaItems(ctx context.Context, options APIFetchOptions) ([]*MediaItem, error) {
+	profileParts := strings.SplitN(options.Profile, ":", 2)
+	feature := profileParts[0]
+
+	if feature != "search" && len(profileParts) != 2 {
+		return nil, fmt.Errorf("Missing value in profile - %s:<value>", feature)
+	}
+
+	if feature != "search" && len(options.Tag) > 0 {
+		return nil, fmt.Errorf("Unsplash supports the tag filter only for search")
+	}
+
+	var endPoint string
+	q := url.Values{}
+
+	switch feature {
+	case "user":
+		endPoint = fmt.Sprintf("/users/%s/photos", url.PathEscape(profileParts[1]))
+	case "collection":
+		endPoint = fmt.Sprintf("/collections/%s/photos", url.PathEscape(profileParts[1]))
+	case "search":
+		if len(options.Tag) == 0 {
+			return nil, fmt.Errorf("Unsplash search requires a tag")
+		}
+
+		endPoint = "/search/photos"
+		q.Set("query", options.Tag)
+	default:
+		return nil, fmt.Errorf("Unknown Unsplash profile %q - use user, collection or search", feature)
+	}
+
+	q.Set("per_page", strconv.Itoa(UnsplashPageSize))
+
+	limit := options.Limit
+	items := make([]*MediaItem, 0, limit)
+
+	for page := 1; limit > 0; page++ {
+		q.Set("page", strconv.Itoa(page))
+
+		pageItems, photos, err := ua.fetchItemsForPage(ctx, ua.BaseURL+endPoint+"?"+q.Encode(), options.Size, options.Square)
+		if err != nil {
+			return nil, err
+		}
+
+		// Remove any items over limit
+		if len(pageItems) > limit {
+			pageItems = pageItems[:limit]
+		}
+
+		items = append(items, pageItems...)
+		limit -= len(pageItems)
+
+		// API sources drained.
+		if photos < UnsplashPageSize {
+			break
+		}
+	}
+
+	return items, nil
+}
+
+func (ua *UnsplashAPI) SupportsOnlySquareImages() bool {
+	return false
+}
+
+func (ua *UnsplashAPI) fetchItemsForPage(ctx context.Context, endPoint string, size int, square bool) ([]*MediaItem, int, error) {
+	req, err := http.NewRequest("GET", endPoint, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Authorization", "Client-ID "+ua.Key)
+	req.Header.Set("Accept-Version", "v1")
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errInfo struct {
+			Errors []string `json:"errors"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&errInfo); err != nil || len(errInfo.Errors) == 0 {
+			return nil, 0, fmt.Errorf("Unsplash responded with %q", resp.Status)
+		}
+
+		return nil, 0, errors.New(strings.Join(errInfo.Errors, ", "))
+	}
+
+	var photos []*unsplashPhoto
+
+	// Search results are wrapped, anything else is a plain list.
+	if strings.Contains(endPoint, "/search/") {
+		var results struct {
+			Results []*unsplashPhoto `json:"results"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			return nil, 0, err
+		}
+
+		photos = results.Results
+	} else if err := json.NewDecoder(resp.Body).Decode(&photos); err != nil {
+		return nil, 0, err
+	}
+
+	mediaItems := make([]*MediaItem, 0, len(photos))
+
+	for _, photo := range photos {
+		if photo.URLs == nil || photo.Width == 0 || photo.Height == 0 {
+			continue
+		}
+
+		item := &MediaItem{ID: photo.ID, Score: photo.Likes}
+
+		// Let Unsplash resize and crop the image to the size we need.
+		params := url.Values{}
+		params.Set("fm", "jpg")
+
+		if square {
+			item.Width, item.Height = size, size
+			params.Set("fit", "crop")
+			params.Set("crop", "entropy")
+			params.Set("w", strconv.Itoa(size))
+			params.Set("h", strconv.Itoa(size))
+		} else {
+			item.Width, item.Height = scaleToLongEdge(photo.Width, photo.Height, size)
+			params.Set("fit", "max")
+			params.Set(longEdgeParam(photo.Width, photo.Height), strconv.Itoa(size))
+		}
+
+		item.URL, err = resizedImageURL(photo.URLs.Raw, params)
+		if err != nil {
+			continue
+		}
+
+		if photo.User != nil {
+			item.Author = photo.User.Name
+
+			if photo.User.Links != nil {
+				item.AuthorURL = photo.User.Links.HTML
+			}
+		}
+
+		mediaItems = append(mediaItems, item)
+	}
+
+	return mediaItems, len(photos), nil
+}
+
+type unsplashPhoto struct {
+	ID     string `json:"id"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Likes  int    `json:"likes"`
+	URLs   *struct {
+		Raw string `json:"raw"`
+	} `json:"urls"`
+	User *struct {
+		Name  string `json:"name"`
+		Links *struct {
+			HTML string `json:"html"`
+		} `json:"links"`
+	} `json:"user"`
+}
+
+// resizedImageURL adds the resize parameters to the query of an
+// image URL of a dynamic resizing service.
+func resizedImageURL(rawURL string, params url.Values) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	for name := range params {
+		q.Set(name, params.Get(name))
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func NewUnsplashAPI(key string) API {
+	return &UnsplashAPI{key, "https://api.unsplash.com"}
+}
+
+func init() {
+	apiFactory.Register("unsplash", NewUnsplashAPI)
+}
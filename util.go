@@ -35,3 +35,22 @@ func absInt(a int) int {
 
 	return a
 }
+
+// scaleToLongEdge scales width and height, keeping the aspect ratio,
+// so that the longest edge equals size.
+func scaleToLongEdge(width, height, size int) (int, int) {
+	ratio := float64(size) / float64(maxInt(width, height))
+
+	return int(ratio * float64(width)), int(ratio * float64(height))
+}
+
+// longEdgeParam returns the name of the resize parameter of the long
+// edge, w or h. APIs which resize the images are only sent the long edge,
+// since they may round the short edge differently than scaleToLongEdge.
+func longEdgeParam(width, height int) string {
+	if width >= height {
+		return "w"
+	}
+
+	return "h"
+}